@@ -2,12 +2,16 @@ package taskmanager
 
 import (
 	"encoding/json"
+	"time"
 )
 
 type Task struct {
 	// Primary Key
 	Id int `json:"id"`
 
+	// Incremented on every update, so that concurrent updates can be detected
+	Version int `json:"version"`
+
 	// Task Reference Id
 	ReferenceId string `json:"referenceId"`
 
@@ -19,6 +23,46 @@ type Task struct {
 	Timeout    int    `json:"timeout"`
 	Message    string `json:"message"`
 	Properties []byte `json:"properties"`
+
+	// Recurring Task Schedule
+	Schedule           string    `json:"schedule"`
+	RecurrenceInterval int       `json:"recurrenceInterval"`
+	NextRunAt          time.Time `json:"nextRunAt"`
+
+	// Failed attempts at the current status, reset when the status changes,
+	// and the history of every handler error
+	Attempt  int           `json:"attempt"`
+	Failures []TaskFailure `json:"failures"`
+
+	// Task Lease, held while a TaskManager runs the task
+	LockedBy       string    `json:"lockedBy"`
+	LeaseExpiresAt time.Time `json:"leaseExpiresAt"`
+
+	// Record Timestamps.  StatusChangedAt is when the task entered its
+	// current Status, which its Timeout is measured from.
+	CreatedAt       time.Time `json:"createdAt"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+	StatusChangedAt time.Time `json:"statusChangedAt"`
+}
+
+// TaskFailure records a handler error for the history in Task.Failures
+type TaskFailure struct {
+	Status   string    `json:"status"`
+	Attempt  int       `json:"attempt"`
+	Message  string    `json:"message"`
+	FailedAt time.Time `json:"failedAt"`
+}
+
+// TaskTransition records a change of Status in the history of a task, and the
+// TaskManager, identified by its lease owner, that made it
+type TaskTransition struct {
+	Id         int       `json:"id"`
+	TaskId     int       `json:"taskId"`
+	FromStatus string    `json:"fromStatus"`
+	ToStatus   string    `json:"toStatus"`
+	Message    string    `json:"message"`
+	Actor      string    `json:"actor"`
+	CreatedAt  time.Time `json:"createdAt"`
 }
 
 func (t *Task) Bytes() []byte {
@@ -0,0 +1,48 @@
+package taskmanager
+
+// TaskAction tells the workflow what to do after a handler returns.  Handlers
+// return one in place of an error, e.g. return taskmanager.Advance, and
+// returning nil is the same as returning Continue.
+type TaskAction struct {
+	action string
+	status string
+}
+
+const (
+	continueAction = "continue"
+	advanceAction  = "advance"
+	goToAction     = "goto"
+	waitAction     = "wait"
+	endAction      = "end"
+)
+
+var (
+	// Continue runs the next handler for the current status
+	Continue = &TaskAction{action: continueAction}
+
+	// Advance moves the task to the next status, as declared in Transitions
+	// or Sequence, and runs its handlers
+	Advance = &TaskAction{action: advanceAction}
+
+	// Wait stops running handlers until the task is resumed with
+	// NotifyTaskWaitStatusResult
+	Wait = &TaskAction{action: waitAction}
+
+	// End stops running handlers and ends the workflow, resetting the task if
+	// it is recurring.  The workflow also ends once the handlers of a terminal
+	// status have run, or Advance is returned there.
+	End = &TaskAction{action: endAction}
+)
+
+// GoTo moves the task to status, which must be declared in Transitions for its
+// current status, e.g. return taskmanager.GoTo("Approved")
+func GoTo(status string) error {
+	return &TaskAction{action: goToAction, status: status}
+}
+
+func (a *TaskAction) Error() string {
+	if a.action == goToAction {
+		return "task action: go to status '" + a.status + "'"
+	}
+	return "task action: " + a.action
+}
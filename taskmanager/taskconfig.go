@@ -0,0 +1,194 @@
+package taskmanager
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+)
+
+// Option configures a TaskManager created with New.  An Option given an
+// invalid value makes New return an error wrapping ErrInvalidOption.
+type Option func(c *config) error
+
+type config struct {
+	ctx       context.Context
+	dataUrl   string
+	db        *sql.DB
+	store     TaskStore
+	workflows map[string]TaskWorkflowDefinition
+	table     string
+	logger    *log.Logger
+	clock     func() time.Time
+	catchUp   CatchUpPolicy
+	lease     time.Duration
+}
+
+// WithContext sets the Context of the TaskManager, whose values are seen by
+// every workflow, and which the methods without a context use
+func WithContext(ctx context.Context) Option {
+	return func(c *config) error {
+		if ctx == nil {
+			return fmt.Errorf("%w: WithContext requires a context", ErrInvalidOption)
+		}
+		c.ctx = ctx
+		return nil
+	}
+}
+
+// WithDataURL stores tasks in the database at dataUrl, which is a Postgres
+// connection string, a sqlite: or file: URL, or memory: for a
+// MemoryTaskStore.  The database is opened by Open.
+func WithDataURL(dataUrl string) Option {
+	return func(c *config) error {
+		if dataUrl == "" {
+			return fmt.Errorf("%w: WithDataURL requires a data URL", ErrInvalidOption)
+		}
+		c.dataUrl = dataUrl
+		return nil
+	}
+}
+
+// WithDB stores tasks in a Postgres or SQLite database opened by the caller.
+// Close leaves it open.  An SQLite :memory: database must be limited to a
+// single connection with SetMaxOpenConns(1).
+func WithDB(db *sql.DB) Option {
+	return func(c *config) error {
+		if db == nil {
+			return fmt.Errorf("%w: WithDB requires a database", ErrInvalidOption)
+		}
+		c.db = db
+		return nil
+	}
+}
+
+// WithStore stores tasks in any TaskStore, such as a MemoryTaskStore
+func WithStore(store TaskStore) Option {
+	return func(c *config) error {
+		if store == nil {
+			return fmt.Errorf("%w: WithStore requires a TaskStore", ErrInvalidOption)
+		}
+		c.store = store
+		return nil
+	}
+}
+
+// WithWorkflows sets the workflow definition for each TaskType.  They are
+// validated by New.
+func WithWorkflows(workflows map[string]TaskWorkflowDefinition) Option {
+	return func(c *config) error {
+		if workflows == nil {
+			return fmt.Errorf("%w: WithWorkflows requires a map of workflow definitions", ErrInvalidOption)
+		}
+		c.workflows = workflows
+		return nil
+	}
+}
+
+var tableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// WithTable sets the database table tasks are stored in, optionally qualified
+// by its schema.  Its history is stored in the same table name with a _history
+// suffix.
+func WithTable(table string) Option {
+	return func(c *config) error {
+		if !tableName.MatchString(table) {
+			return fmt.Errorf("%w: WithTable requires a table name: '%s'", ErrInvalidOption, table)
+		}
+		c.table = table
+		return nil
+	}
+}
+
+// WithLogger sets the logger for the TaskManager and its default workflow
+// handlers, instead of the standard logger
+func WithLogger(logger *log.Logger) Option {
+	return func(c *config) error {
+		if logger == nil {
+			return fmt.Errorf("%w: WithLogger requires a logger", ErrInvalidOption)
+		}
+		c.logger = logger
+		return nil
+	}
+}
+
+// WithClock sets the clock used to schedule recurring tasks, time out tasks
+// and record failures.  Leases always follow the clock of the TaskStore.
+func WithClock(now func() time.Time) Option {
+	return func(c *config) error {
+		if now == nil {
+			return fmt.Errorf("%w: WithClock requires a clock", ErrInvalidOption)
+		}
+		c.clock = now
+		return nil
+	}
+}
+
+// WithCatchUp sets what the scheduler does with a recurring task that has
+// missed one or more runs.  The default is CatchUpRunOnce.
+func WithCatchUp(policy CatchUpPolicy) Option {
+	return func(c *config) error {
+		if policy < CatchUpRunOnce || policy > CatchUpRunAll {
+			return fmt.Errorf("%w: WithCatchUp requires a CatchUpPolicy: %d", ErrInvalidOption, policy)
+		}
+		c.catchUp = policy
+		return nil
+	}
+}
+
+// WithLeaseDuration sets how long a claimed task stays locked without a
+// Heartbeat before another worker may reclaim it.  The default is 5 minutes.
+func WithLeaseDuration(d time.Duration) Option {
+	return func(c *config) error {
+		if d <= 0 {
+			return fmt.Errorf("%w: WithLeaseDuration requires a positive duration: %s", ErrInvalidOption, d)
+		}
+		c.lease = d
+		return nil
+	}
+}
+
+// taskStore returns the TaskStore chosen by WithDB or WithStore, or nil for a
+// data URL that is opened later by Open
+func (c *config) taskStore() (TaskStore, error) {
+	sources := 0
+	for _, given := range []bool{c.dataUrl != "", c.db != nil, c.store != nil} {
+		if given {
+			sources++
+		}
+	}
+	if sources == 0 {
+		return nil, fmt.Errorf("%w: one of WithDataURL, WithDB or WithStore is required", ErrInvalidOption)
+	}
+	if sources > 1 {
+		return nil, fmt.Errorf("%w: only one of WithDataURL, WithDB and WithStore may be given", ErrInvalidOption)
+	}
+
+	if c.db != nil {
+		s, err := newSqlTaskStore(c.db, c.table, c.logger)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	return c.store, nil
+}
+
+// println logs to the logger given with WithLogger, or the standard logger
+func (m *TaskManager) println(v ...interface{}) {
+	if m.logger == nil {
+		log.Println(v...)
+		return
+	}
+	m.logger.Println(v...)
+}
+
+// now returns the time on the clock given with WithClock, or the current time
+func (m *TaskManager) now() time.Time {
+	if m.clock == nil {
+		return time.Now()
+	}
+	return m.clock()
+}
@@ -1,14 +1,149 @@
 package taskmanager
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"log"
 	"strconv"
+	"strings"
+	"time"
 )
 
+type sqlTaskStore struct {
+	db         *sql.DB
+	driverName string
+	table      string
+
+	// borrowed is set for a database opened by the caller, which Close leaves open
+	borrowed bool
+
+	// logger is given with WithLogger, or nil for the standard logger
+	logger *log.Logger
+}
+
+func openSqlTaskStore(driverName string, dataUrl string, table string) (*sqlTaskStore, error) {
+	// Open Connection
+	db, err := sql.Open(driverName, dataUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlTaskStore{
+		db:         db,
+		driverName: driverName,
+		table:      table,
+	}, nil
+}
+
+// newSqlTaskStore uses a database opened by the caller with WithDB
+func newSqlTaskStore(db *sql.DB, table string, logger *log.Logger) (*sqlTaskStore, error) {
+	if isSqliteDB(db) {
+		s := &sqlTaskStore{db: db, driverName: sqliteDriverName, table: table, borrowed: true, logger: logger}
+		err := s.createSqliteTables()
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	return &sqlTaskStore{
+		db:         db,
+		driverName: "postgres",
+		table:      table,
+		borrowed:   true,
+		logger:     logger,
+	}, nil
+}
+
+func (s *sqlTaskStore) Close() error {
+	if s.borrowed {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// rebind adapts a query written for Postgres to the SQL dialect of the store
+func (s *sqlTaskStore) rebind(query string) string {
+	if s.driverName != sqliteDriverName {
+		return query
+	}
+
+	// SQLite has no ILIKE (LIKE is already case-insensitive) or LIMIT ALL and
+	// numbers its parameters ?1, ?2, ... rather than $1, $2, ...
+	query = strings.ReplaceAll(query, " ILIKE ", " LIKE ")
+	query = strings.ReplaceAll(query, " LIMIT ALL", " LIMIT -1")
+
+	// SQLite has no row locks since it only allows a single writer
+	query = strings.ReplaceAll(query, " FOR UPDATE SKIP LOCKED", "")
+
+	// CURRENT_TIMESTAMP only has second precision in SQLite
+	query = strings.ReplaceAll(query, "CURRENT_TIMESTAMP", sqliteTimestamp)
+
+	return strings.ReplaceAll(query, "$", "?")
+}
+
+// bind adapts query arguments to the SQL dialect of the store
+func (s *sqlTaskStore) bind(args []interface{}) []interface{} {
+	if s.driverName != sqliteDriverName {
+		return args
+	}
+
+	// SQLite compares timestamps as text, so times must use the same UTC
+	// format as the timestamps written by the database itself
+	result := make([]interface{}, len(args))
+	for i := range args {
+		switch t := args[i].(type) {
+		case time.Time:
+			result[i] = t.UTC().Format(sqliteTimestampFormat)
+		case sql.NullTime:
+			if t.Valid {
+				result[i] = t.Time.UTC().Format(sqliteTimestampFormat)
+			}
+		default:
+			result[i] = args[i]
+		}
+	}
+	return result
+}
+
+// sqlNullTime stores the zero time as NULL
+func sqlNullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{
+		Time:  t,
+		Valid: !t.IsZero(),
+	}
+}
+
+// sqlNullFailures stores the failure history as JSON, and no failures as NULL
+func sqlNullFailures(failures []TaskFailure) sql.NullString {
+	if len(failures) == 0 {
+		return sql.NullString{}
+	}
+	b, _ := json.Marshal(failures)
+	return sql.NullString{
+		String: string(b),
+		Valid:  true,
+	}
+}
+
+func sqlTaskFailures(s sql.NullString) ([]TaskFailure, error) {
+	if !s.Valid {
+		return nil, nil
+	}
+
+	var failures []TaskFailure
+	err := json.Unmarshal([]byte(s.String), &failures)
+	return failures, err
+}
+
 type sqlTask struct {
 	// Primary Key
 	Id sql.NullInt32 `sql:"id"`
 
+	// Record Version
+	Version sql.NullInt32 `sql:"version"`
+
 	// Task Reference Id
 	ReferenceId sql.NullString `sql:"reference_id"`
 
@@ -20,11 +155,52 @@ type sqlTask struct {
 	Timeout    sql.NullInt32  `sql:"timeout"`
 	Message    sql.NullString `sql:"message"`
 	Properties []byte         `sql:"properties"`
+
+	// Recurring Task Schedule
+	Schedule           sql.NullString `sql:"schedule"`
+	RecurrenceInterval sql.NullInt32  `sql:"recurrence_interval"`
+	NextRunAt          sql.NullTime   `sql:"next_run_at"`
+
+	// Task Retries
+	Attempt  sql.NullInt32  `sql:"attempt"`
+	Failures sql.NullString `sql:"failures"`
+
+	// Task Lease
+	LockedBy       sql.NullString `sql:"locked_by"`
+	LeaseExpiresAt sql.NullTime   `sql:"lease_expires_at"`
+
+	// Record Timestamps
+	CreatedAt       sql.NullTime `sql:"created_at"`
+	UpdatedAt       sql.NullTime `sql:"updated_at"`
+	StatusChangedAt sql.NullTime `sql:"status_changed_at"`
+}
+
+// task converts a row read by the store to a Task.  Failures that cannot be
+// read are logged rather than failing the read.
+func (s *sqlTaskStore) task(t *sqlTask) Task {
+	task := t.task()
+
+	var err error
+	task.Failures, err = sqlTaskFailures(t.Failures)
+	if err != nil {
+		s.println("Warning: could not read task failures:", err)
+	}
+	return task
+}
+
+// println logs to the logger given with WithLogger, or the standard logger
+func (s *sqlTaskStore) println(v ...interface{}) {
+	if s.logger == nil {
+		log.Println(v...)
+		return
+	}
+	s.logger.Println(v...)
 }
 
 func (t *sqlTask) task() Task {
 	task := Task{
 		Id:          int(t.Id.Int32),
+		Version:     int(t.Version.Int32),
 		ReferenceId: t.ReferenceId.String,
 		TaskGroup:   t.TaskGroup.String,
 		TaskType:    t.TaskType.String,
@@ -33,6 +209,19 @@ func (t *sqlTask) task() Task {
 		Timeout:     int(t.Timeout.Int32),
 		Message:     t.Message.String,
 		Properties:  t.Properties,
+
+		Schedule:           t.Schedule.String,
+		RecurrenceInterval: int(t.RecurrenceInterval.Int32),
+		NextRunAt:          t.NextRunAt.Time,
+
+		Attempt: int(t.Attempt.Int32),
+
+		LockedBy:       t.LockedBy.String,
+		LeaseExpiresAt: t.LeaseExpiresAt.Time,
+
+		CreatedAt:       t.CreatedAt.Time,
+		UpdatedAt:       t.UpdatedAt.Time,
+		StatusChangedAt: t.StatusChangedAt.Time,
 	}
 
 	return task
@@ -44,15 +233,21 @@ func rowSqlSourceTask(t Task) []interface{} {
 		t.TaskGroup, t.TaskType,
 		t.Recurring, t.Status, t.Timeout, t.Message,
 		t.Properties,
+		t.Schedule, t.RecurrenceInterval, sqlNullTime(t.NextRunAt),
+		t.Attempt, sqlNullFailures(t.Failures),
 	}
 }
 
 func (t *sqlTask) rowSqlDestination() []interface{} {
 	return []interface{}{
-		&t.Id, &t.ReferenceId,
+		&t.Id, &t.Version, &t.ReferenceId,
 		&t.TaskGroup, &t.TaskType,
 		&t.Recurring, &t.Status, &t.Timeout, &t.Message,
 		&t.Properties,
+		&t.Schedule, &t.RecurrenceInterval, &t.NextRunAt,
+		&t.Attempt, &t.Failures,
+		&t.LockedBy, &t.LeaseExpiresAt,
+		&t.CreatedAt, &t.UpdatedAt, &t.StatusChangedAt,
 	}
 }
 
@@ -61,7 +256,22 @@ const sqlTaskColumns = `
     reference_id,
     task_group, task_type,
     recurring, status, timeout, message,
-    properties`
+    properties,
+    schedule, recurrence_interval, next_run_at,
+    attempt, failures`
+
+// The task lease is only written by ClaimTask, RenewLease and ReleaseTask, and
+// the record timestamps are maintained by the database.  status_changed_at is
+// only changed by an update that changes the status, so that writing the lease
+// does not restart the timeout of the status.
+const sqlTaskLeaseColumns = `
+    locked_by, lease_expires_at`
+const sqlTaskTimestampColumns = `
+    created_at, updated_at, status_changed_at`
+
+// sqlTaskReadColumns are the columns read into a sqlTask by rowSqlDestination.
+// The version is only written by UpdateTask, which increments it.
+const sqlTaskReadColumns = `id, version, ` + sqlTaskColumns + `, ` + sqlTaskLeaseColumns + `, ` + sqlTaskTimestampColumns
 
 func sqlQueryTaskTable(t string) string {
 	if t == "" {
@@ -74,16 +284,17 @@ func sqlCreateTask(t string) string {
 	return `
         INSERT INTO ` + sqlQueryTaskTable(t) +
 		` (` + sqlTaskColumns + `)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-        RETURNING id`
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+        RETURNING id, version, ` + sqlTaskTimestampColumns
 }
 
 func sqlUpdateTask(t string) string {
 	return `
         UPDATE ` + sqlQueryTaskTable(t) + `
-        SET (` + sqlTaskColumns + `) =
-        ($2, $3, $4, $5, $6, $7, $8, $9)
-        WHERE id = $1`
+        SET (` + sqlTaskColumns + `, version) =
+        ($2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, version + 1),
+        status_changed_at = CASE WHEN status = $6 THEN status_changed_at ELSE CURRENT_TIMESTAMP END
+        WHERE id = $1 AND version = $15`
 }
 
 func sqlCountAllTasks(t string) string {
@@ -92,9 +303,13 @@ func sqlCountAllTasks(t string) string {
         FROM ` + sqlQueryTaskTable(t)
 }
 
+func sqlCountTask(t string) string {
+	return sqlCountAllTasks(t) + " WHERE id = $1"
+}
+
 func sqlFindAllTasks(t string) string {
 	return `
-        SELECT id, ` + sqlTaskColumns + `
+        SELECT ` + sqlTaskReadColumns + `
         FROM ` + sqlQueryTaskTable(t)
 }
 
@@ -102,16 +317,51 @@ func sqlFindTask(t string) string {
 	return sqlFindAllTasks(t) + " WHERE id = $1"
 }
 
-func sqlFindAllTasksByGroupAndStatus(t string) string {
-	return sqlFindAllTasks(t) + " WHERE task_group = $1 AND status = $2"
+func sqlClaimTask(t string, where string) string {
+	return `
+        UPDATE ` + sqlQueryTaskTable(t) + `
+        SET locked_by = $1, lease_expires_at = $2
+        WHERE id = (
+            SELECT id
+            FROM ` + sqlQueryTaskTable(t) + `
+            WHERE ` + where + `
+            ORDER BY id
+            LIMIT 1
+            FOR UPDATE SKIP LOCKED)
+        RETURNING ` + sqlTaskReadColumns
 }
 
-func sqlFindAllTasksByTypeAndStatus(t string) string {
-	return sqlFindAllTasks(t) + " WHERE task_type = $1 AND status = $2"
+func sqlRenewLease(t string) string {
+	return `
+        UPDATE ` + sqlQueryTaskTable(t) + `
+        SET lease_expires_at = $3
+        WHERE id = $1 AND locked_by = $2`
 }
 
-func sqlFindAllRecurringTasks(t string) string {
-	return sqlFindAllTasks(t) + " WHERE recurring IS true"
+func sqlReleaseTask(t string) string {
+	return `
+        UPDATE ` + sqlQueryTaskTable(t) + `
+        SET locked_by = NULL, lease_expires_at = NULL
+        WHERE id = $1 AND locked_by = $2`
+}
+
+func sqlHistoryTable(t string) string {
+	return sqlQueryTaskTable(t) + "_history"
+}
+
+func sqlAddTaskHistory(t string) string {
+	return `
+        INSERT INTO ` + sqlHistoryTable(t) + `
+        (task_id, from_status, to_status, message, actor)
+        VALUES ($1, $2, $3, $4, $5)`
+}
+
+func sqlFindTaskHistory(t string) string {
+	return `
+        SELECT id, task_id, from_status, to_status, message, actor, created_at
+        FROM ` + sqlHistoryTable(t) + `
+        WHERE task_id = $1
+        ORDER BY id`
 }
 
 func sqlDeleteTask(t string) string {
@@ -120,25 +370,25 @@ func sqlDeleteTask(t string) string {
         WHERE id = $1`
 }
 
-func (m *TaskManager) CreateTask(t Task) (Task, error) {
-	if t.Timeout < 1 {
-		t.Timeout = -1
-	}
-	t.Status = "Created"
-
-	var id int
-	row := m.db.QueryRow(sqlCreateTask(m.DatabaseTable), rowSqlSourceTask(t)...)
-	err := row.Scan(&id)
+func (s *sqlTaskStore) CreateTask(ctx context.Context, t Task) (Task, error) {
+	var id, version int
+	var createdAt, updatedAt, statusChangedAt sql.NullTime
+	row := s.db.QueryRowContext(ctx, s.rebind(sqlCreateTask(s.table)), s.bind(rowSqlSourceTask(t))...)
+	err := row.Scan(&id, &version, &createdAt, &updatedAt, &statusChangedAt)
 	if err != nil {
 		return Task{}, err
 	}
 
 	t.Id = id
+	t.Version = version
+	t.CreatedAt = createdAt.Time
+	t.UpdatedAt = updatedAt.Time
+	t.StatusChangedAt = statusChangedAt.Time
 	return t, nil
 }
 
-func (m *TaskManager) CountAllTasks() (int, error) {
-	row := m.db.QueryRow(sqlCountAllTasks(m.DatabaseTable))
+func (s *sqlTaskStore) CountAllTasks(ctx context.Context) (int, error) {
+	row := s.db.QueryRowContext(ctx, s.rebind(sqlCountAllTasks(s.table)))
 
 	var count int
 	err := row.Scan(&count)
@@ -148,8 +398,13 @@ func (m *TaskManager) CountAllTasks() (int, error) {
 	return count, nil
 }
 
-func (m *TaskManager) FindAllTasks(options map[string]string) ([]Task, error) {
-	rows, err := m.db.Query(sqlFindAllTasks(m.DatabaseTable) + findAllOptionsString(options))
+func (s *sqlTaskStore) FindAllTasks(ctx context.Context, options *FindOptions) ([]Task, error) {
+	optionsSQL, args, err := options.sql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(sqlFindAllTasks(s.table)+optionsSQL), s.bind(args)...)
 
 	var result []Task
 	if err != nil {
@@ -162,134 +417,173 @@ func (m *TaskManager) FindAllTasks(options map[string]string) ([]Task, error) {
 			_ = rows.Close()
 			return nil, err
 		}
-		result = append(result, t.task())
+		result = append(result, s.task(&t))
 	}
 	_ = rows.Close()
 
 	return result, nil
 }
 
-func (m *TaskManager) FindTask(id int) (Task, error) {
-	row := m.db.QueryRow(sqlFindTask(m.DatabaseTable), id)
+func (s *sqlTaskStore) FindTask(ctx context.Context, id int) (Task, error) {
+	row := s.db.QueryRowContext(ctx, s.rebind(sqlFindTask(s.table)), id)
 
 	var t sqlTask
 	err := row.Scan(t.rowSqlDestination()...)
 	if err != nil {
 		return Task{}, err
 	}
-	return t.task(), nil
+	return s.task(&t), nil
 }
 
-func (m *TaskManager) FindAllTasksByGroupAndStatus(taskGroup string, status string, options map[string]string) ([]Task, error) {
-	rows, err := m.db.Query(sqlFindAllTasksByGroupAndStatus(m.DatabaseTable)+findAllOptionsString(options), taskGroup, status)
+// sqlExecer is either the database or a transaction
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
 
-	var result []Task
+func (s *sqlTaskStore) UpdateTask(ctx context.Context, t Task) error {
+	return s.updateTask(ctx, s.db, t)
+}
+
+func (s *sqlTaskStore) TransitionTask(ctx context.Context, t Task, h TaskTransition) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	for rows.Next() {
-		var t sqlTask
-		err := rows.Scan(t.rowSqlDestination()...)
-		if err != nil {
-			_ = rows.Close()
-			return nil, err
-		}
-		result = append(result, t.task())
+
+	err = s.updateTask(ctx, tx, t)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
 	}
-	_ = rows.Close()
 
-	return result, nil
+	_, err = tx.ExecContext(ctx, s.rebind(sqlAddTaskHistory(s.table)), h.TaskId, h.FromStatus, h.ToStatus, h.Message, h.Actor)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (m *TaskManager) FindAllTasksByTypeAndStatus(taskType string, status string, options map[string]string) ([]Task, error) {
-	rows, err := m.db.Query(sqlFindAllTasksByTypeAndStatus(m.DatabaseTable)+findAllOptionsString(options), taskType, status)
+func (s *sqlTaskStore) updateTask(ctx context.Context, db sqlExecer, t Task) error {
+	args := append([]interface{}{t.Id}, rowSqlSourceTask(t)...)
+	args = append(args, t.Version)
 
-	var result []Task
+	result, err := db.ExecContext(ctx, s.rebind(sqlUpdateTask(s.table)), s.bind(args)...)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	for rows.Next() {
-		var t sqlTask
-		err := rows.Scan(t.rowSqlDestination()...)
-		if err != nil {
-			_ = rows.Close()
-			return nil, err
-		}
-		result = append(result, t.task())
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
 	}
-	_ = rows.Close()
 
-	return result, nil
+	// No row matched the id and version, so tell a missing task apart from
+	// one that has been updated since it was read
+	var count int
+	err = db.QueryRowContext(ctx, s.rebind(sqlCountTask(s.table)), t.Id).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return sql.ErrNoRows
+	}
+	return ErrConcurrentModification
 }
 
-func (m *TaskManager) FindAllRecurringTasks(options map[string]string) ([]Task, error) {
-	rows, err := m.db.Query(sqlFindAllRecurringTasks(m.DatabaseTable) + findAllOptionsString(options))
+func (s *sqlTaskStore) DeleteTask(ctx context.Context, id int) error {
+	result, err := s.db.ExecContext(ctx, s.rebind(sqlDeleteTask(s.table)), id)
+	if err != nil {
+		return err
+	}
 
-	var result []Task
+	n, err := result.RowsAffected()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	for rows.Next() {
-		var t sqlTask
-		err := rows.Scan(t.rowSqlDestination()...)
-		if err != nil {
-			_ = rows.Close()
-			return nil, err
-		}
-		result = append(result, t.task())
+	if n == 0 {
+		return sql.ErrNoRows
 	}
-	_ = rows.Close()
-
-	return result, nil
+	return nil
 }
 
-func (m *TaskManager) UpdateTask(t Task) error {
-	if t.Timeout < 1 {
-		t.Timeout = -1
+func (s *sqlTaskStore) ClaimTask(ctx context.Context, where *Predicate, owner string, lease time.Duration) (Task, error) {
+	err := where.Validate()
+	if err != nil {
+		return Task{}, err
 	}
 
-	_, err := m.db.Exec(sqlUpdateTask(m.DatabaseTable), append([]interface{}{t.Id}, rowSqlSourceTask(t)...)...)
-	return err
-}
+	// Only claim tasks that are not locked or whose lease has expired
+	now := time.Now()
+	where = And(where, Or(IsNull("lease_expires_at"), Lt("lease_expires_at", now)))
 
-func (m *TaskManager) DeleteTask(id int) error {
-	_, err := m.db.Exec(sqlDeleteTask(m.DatabaseTable), id)
-	return err
+	args := []interface{}{owner, now.Add(lease)}
+	param := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	query := sqlClaimTask(s.table, where.sql(param))
+
+	row := s.db.QueryRowContext(ctx, s.rebind(query), s.bind(args)...)
+
+	var t sqlTask
+	err = row.Scan(t.rowSqlDestination()...)
+	if err != nil {
+		return Task{}, err
+	}
+	return s.task(&t), nil
 }
 
-func findAllOptionsString(options map[string]string) string {
-	defined := make(map[string]bool)
-	for i := range options {
-		defined[i] = options[i] != ""
+func (s *sqlTaskStore) RenewLease(ctx context.Context, id int, owner string, lease time.Duration) error {
+	result, err := s.db.ExecContext(ctx, s.rebind(sqlRenewLease(s.table)), s.bind([]interface{}{id, owner, time.Now().Add(lease)})...)
+	if err != nil {
+		return err
 	}
 
-	filterSQL := " "
-	sortSQL := " "
-	rangeSQL := " "
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
 
-	if options != nil {
-		if defined["filterColumn"] && defined["filterValue"] {
-			filterSQL = " WHERE " + options["filterColumn"] + " ILIKE '" + options["filterValue"] + "%' "
-		}
-		if defined["sortColumn"] && defined["sortOrder"] {
-			sortSQL = " ORDER BY " + options["sortColumn"] + " " + options["sortOrder"] + " "
-		}
-		if defined["rangeStart"] && defined["rangeEnd"] {
-			rangeStart, err := strconv.Atoi(options["rangeStart"])
-			if err != nil {
-				return ""
-			}
-			rangeEnd, err := strconv.Atoi(options["rangeEnd"])
-			if err != nil {
-				return ""
-			}
+func (s *sqlTaskStore) ReleaseTask(ctx context.Context, id int, owner string) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(sqlReleaseTask(s.table)), id, owner)
+	return err
+}
 
-			limit := rangeEnd - rangeStart
-			offset := rangeStart
+func (s *sqlTaskStore) FindTaskHistory(ctx context.Context, taskId int) ([]TaskTransition, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(sqlFindTaskHistory(s.table)), taskId)
+	if err != nil {
+		return nil, err
+	}
 
-			rangeSQL = " LIMIT " + strconv.Itoa(limit) + " OFFSET " + strconv.Itoa(offset) + " "
+	var result []TaskTransition
+	for rows.Next() {
+		var h TaskTransition
+		var fromStatus, toStatus, message, actor sql.NullString
+		var createdAt sql.NullTime
+		err := rows.Scan(&h.Id, &h.TaskId, &fromStatus, &toStatus, &message, &actor, &createdAt)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
 		}
+		h.FromStatus = fromStatus.String
+		h.ToStatus = toStatus.String
+		h.Message = message.String
+		h.Actor = actor.String
+		h.CreatedAt = createdAt.Time
+		result = append(result, h)
 	}
+	_ = rows.Close()
 
-	return filterSQL + sortSQL + rangeSQL
+	return result, nil
 }
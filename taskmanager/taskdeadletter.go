@@ -0,0 +1,48 @@
+package taskmanager
+
+import "context"
+
+// FindDeadLetterTasks returns the tasks that were given up on after
+// exhausting the retries for one of their statuses
+func (m *TaskManager) FindDeadLetterTasks(options *FindOptions) ([]Task, error) {
+	return m.FindDeadLetterTasksContext(m.context(), options)
+}
+
+func (m *TaskManager) FindDeadLetterTasksContext(ctx context.Context, options *FindOptions) ([]Task, error) {
+	return m.store.FindAllTasks(ctx, options.where(Eq("status", "DeadLetter")))
+}
+
+// RequeueDeadLetterTask moves a DeadLetter task back to Created with no failed
+// attempts, so that it is run again from the start of its workflow.  The
+// history in Failures is kept.
+func (m *TaskManager) RequeueDeadLetterTask(id int) error {
+	return m.RequeueDeadLetterTaskContext(m.context(), id)
+}
+
+func (m *TaskManager) RequeueDeadLetterTaskContext(ctx context.Context, id int) error {
+	task, err := m.FindTaskContext(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if !m.ValidTaskType(task.TaskType) {
+		return newTaskError(task, "error requeueing task: %w: %s", ErrInvalidTaskType, task.TaskType)
+	}
+
+	if task.Status != "DeadLetter" {
+		return newTaskError(task, "error requeueing task: %w: task must be in DeadLetter state before requeueing",
+			ErrInvalidState)
+	}
+
+	w := m.newTaskWorkflow(ctx, task)
+	task.Status = "Created"
+	task.Timeout = w.Timeouts["Created"]
+	task.Message = ""
+	task.Attempt = 0
+
+	err = m.transitionTask(ctx, task, "DeadLetter", "requeued")
+	if err != nil {
+		return newTaskError(task, "error requeueing task: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package taskmanager
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// workflowDiagram is the state machine of a TaskWorkflow, as drawn by DOT
+// and Mermaid
+type workflowDiagram struct {
+	statuses []string
+	start    string
+	waits    map[string]bool
+	ends     map[string]bool
+	edges    []diagramEdge
+}
+
+type diagramEdge struct {
+	from    string
+	to      string
+	label   string
+	failure bool
+}
+
+func (d workflowDiagram) hasStatus(status string) bool {
+	for _, s := range d.statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *TaskWorkflow) diagram() workflowDiagram {
+	d := workflowDiagram{
+		waits: make(map[string]bool),
+		ends:  make(map[string]bool),
+	}
+
+	// Statuses in Sequence order, then those only reached with GoTo
+	seen := make(map[string]bool)
+	addStatus := func(status string) {
+		if !seen[status] {
+			seen[status] = true
+			d.statuses = append(d.statuses, status)
+		}
+	}
+	for _, status := range w.Sequence {
+		addStatus(status)
+	}
+	for _, from := range sortedKeys(w.Transitions) {
+		addStatus(from)
+		for _, to := range w.Transitions[from] {
+			addStatus(to)
+		}
+	}
+	if len(w.Sequence) > 0 {
+		d.start = w.Sequence[0]
+	}
+
+	var failures []diagramEdge
+	for _, status := range d.statuses {
+		if isFailureStatus(status) {
+			continue
+		}
+		d.waits[status] = w.isWait(status)
+		d.ends[status] = w.isTerminal(status)
+
+		// Declared transitions, or the next status in Sequence
+		if next, declared := w.Transitions[status]; declared {
+			for _, to := range next {
+				d.edges = append(d.edges, diagramEdge{from: status, to: to})
+			}
+		} else {
+			for i := 0; i < len(w.Sequence)-1; i++ {
+				if w.Sequence[i] == status {
+					label := ""
+					if d.waits[status] {
+						label = "notify"
+					}
+					d.edges = append(d.edges, diagramEdge{from: status, to: w.Sequence[i+1], label: label})
+				}
+			}
+		}
+
+		if d.ends[status] {
+			continue
+		}
+		failures = append(failures, diagramEdge{from: status, to: "Error", label: "error", failure: true})
+		if timeout := w.Timeouts[status]; timeout > 0 {
+			failures = append(failures, diagramEdge{from: status, to: "Timeout",
+				label: "after " + strconv.Itoa(timeout) + "s", failure: true})
+		}
+		if p, retries := w.Retries[status]; retries && p.MaxAttempts > 1 {
+			failures = append(failures, diagramEdge{from: status, to: "DeadLetter",
+				label: "after " + strconv.Itoa(p.MaxAttempts) + " attempts", failure: true})
+		}
+	}
+
+	// Failure statuses are drawn last, and only when they can be reached
+	for _, status := range failureStatuses {
+		for _, e := range failures {
+			if e.to == status {
+				addStatus(status)
+				break
+			}
+		}
+	}
+	d.edges = append(d.edges, failures...)
+
+	return d
+}
+
+// DOT renders the workflow as a Graphviz digraph.  Wait states are drawn with
+// a double border, end states as double circles, and failure transitions as
+// dashed edges.  If task is not nil its current status is highlighted.
+func (w *TaskWorkflow) DOT(task *Task) string {
+	d := w.diagram()
+
+	var b strings.Builder
+	b.WriteString("digraph TaskWorkflow {\n")
+	b.WriteString("    rankdir=LR;\n")
+	b.WriteString("    node [shape=box, style=rounded];\n")
+
+	if d.start != "" {
+		// The start point must not share its id with a status
+		start := "start"
+		for d.hasStatus(start) {
+			start = "_" + start
+		}
+		b.WriteString("    " + start + " [shape=point];\n")
+		b.WriteString("    " + start + " -> " + dotId(d.start) + ";\n")
+	}
+
+	for _, status := range d.statuses {
+		var attributes []string
+		switch {
+		case d.ends[status]:
+			attributes = append(attributes, "shape=doublecircle")
+		case d.waits[status]:
+			attributes = append(attributes, "peripheries=2")
+		case isFailureStatus(status):
+			attributes = append(attributes, "shape=octagon")
+		}
+		if task != nil && task.Status == status {
+			attributes = append(attributes, `style="rounded,filled"`, "fillcolor=yellow")
+		}
+
+		b.WriteString("    " + dotId(status))
+		if len(attributes) > 0 {
+			b.WriteString(" [" + strings.Join(attributes, ", ") + "]")
+		}
+		b.WriteString(";\n")
+	}
+
+	for _, e := range d.edges {
+		var attributes []string
+		if e.label != "" {
+			attributes = append(attributes, "label="+dotId(e.label))
+		}
+		if e.failure {
+			attributes = append(attributes, "style=dashed")
+		}
+
+		b.WriteString("    " + dotId(e.from) + " -> " + dotId(e.to))
+		if len(attributes) > 0 {
+			b.WriteString(" [" + strings.Join(attributes, ", ") + "]")
+		}
+		b.WriteString(";\n")
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Mermaid renders the workflow as a Mermaid state diagram.  Wait and end
+// states are noted, and failure transitions are drawn like any other.  If task
+// is not nil its current status is highlighted.
+func (w *TaskWorkflow) Mermaid(task *Task) string {
+	d := w.diagram()
+	ids := d.mermaidIds()
+	mermaidId := func(status string) string {
+		if id, ok := ids[status]; ok {
+			return id
+		}
+		return mermaidInvalid.ReplaceAllString(status, "_")
+	}
+
+	var b strings.Builder
+	b.WriteString("stateDiagram-v2\n")
+
+	for _, status := range d.statuses {
+		if mermaidId(status) != status {
+			b.WriteString("    state \"" + status + "\" as " + mermaidId(status) + "\n")
+		}
+	}
+
+	if d.start != "" {
+		b.WriteString("    [*] --> " + mermaidId(d.start) + "\n")
+	}
+	for _, e := range d.edges {
+		b.WriteString("    " + mermaidId(e.from) + " --> " + mermaidId(e.to))
+		if e.label != "" {
+			b.WriteString(" : " + e.label)
+		}
+		b.WriteString("\n")
+	}
+	for _, status := range d.statuses {
+		if d.ends[status] {
+			b.WriteString("    " + mermaidId(status) + " --> [*]\n")
+		}
+	}
+
+	for _, status := range d.statuses {
+		if d.waits[status] {
+			b.WriteString("    note right of " + mermaidId(status) + " : waits for notify\n")
+		}
+	}
+
+	if task != nil && task.Status != "" {
+		b.WriteString("    classDef current fill:#ff0,stroke:#333\n")
+		b.WriteString("    class " + mermaidId(task.Status) + " current\n")
+	}
+
+	return b.String()
+}
+
+var dotIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// dotKeywords cannot be used as plain names, whatever their case
+var dotKeywords = []string{"node", "edge", "graph", "digraph", "subgraph", "strict"}
+
+// dotId quotes a DOT identifier unless it is a plain name
+func dotId(s string) string {
+	if !dotIdentifier.MatchString(s) {
+		return strconv.Quote(s)
+	}
+	for _, keyword := range dotKeywords {
+		if strings.EqualFold(s, keyword) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+var mermaidInvalid = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// mermaidIds gives each status a Mermaid state id.  A status that is already
+// a valid id keeps it, and the others have the characters Mermaid does not
+// allow replaced, with "_" appended while the id is taken by another status.
+func (d workflowDiagram) mermaidIds() map[string]string {
+	ids := make(map[string]string)
+	taken := make(map[string]bool)
+	for _, status := range d.statuses {
+		if !mermaidInvalid.MatchString(status) {
+			ids[status] = status
+			taken[status] = true
+		}
+	}
+	for _, status := range d.statuses {
+		if _, ok := ids[status]; ok {
+			continue
+		}
+		id := mermaidInvalid.ReplaceAllString(status, "_")
+		for taken[id] {
+			id += "_"
+		}
+		ids[status] = id
+		taken[id] = true
+	}
+	return ids
+}
@@ -0,0 +1,151 @@
+package taskmanager
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrTaskNotFound is returned for a task id that does not exist
+	ErrTaskNotFound = errors.New("task not found")
+
+	// ErrInvalidTaskType is returned for a task whose TaskType has no workflow
+	ErrInvalidTaskType = errors.New("invalid task type")
+
+	// ErrInvalidState is returned when the status or lease of a task does
+	// not allow the operation, e.g. starting a task that is not Created
+	ErrInvalidState = errors.New("invalid task state")
+
+	// ErrConcurrentModification is returned when updating a task that has been
+	// updated by someone else since it was read
+	ErrConcurrentModification = errors.New("task was modified concurrently")
+
+	// ErrInvalidOption is returned by New for an Option with an invalid value,
+	// or a combination of options that cannot be used together
+	ErrInvalidOption = errors.New("invalid task manager option")
+)
+
+// TaskError is returned by TaskManager operations that fail for a task.  It
+// wraps the cause, so that errors.Is and errors.As see ErrTaskNotFound,
+// ErrInvalidTaskType, ErrInvalidState, ErrConcurrentModification and the
+// errors returned by handlers.
+type TaskError struct {
+	TaskId int
+	Status string
+	Err    error
+}
+
+func (e *TaskError) Error() string {
+	message := "task ID " + strconv.Itoa(e.TaskId)
+	if e.Status != "" {
+		message += " with status '" + e.Status + "'"
+	}
+	return message + ": " + e.Err.Error()
+}
+
+func (e *TaskError) Unwrap() error {
+	return e.Err
+}
+
+// newTaskError returns a *TaskError for t, with a cause formatted by
+// fmt.Errorf so that it can wrap another error with %w
+func newTaskError(t Task, format string, args ...interface{}) error {
+	return &TaskError{
+		TaskId: t.Id,
+		Status: t.Status,
+		Err:    fmt.Errorf(format, args...),
+	}
+}
+
+// Handlers may wrap the errors they return to tell the workflow what to do
+// with them.  An unwrapped error is retried by the RetryPolicy for the status,
+// if it has one, and otherwise fails the task.
+
+// Retryable marks err as transient.  The handlers for the status are retried
+// by its RetryPolicy, or by DefaultRetryPolicy if it has none.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err: err}
+}
+
+// Permanent marks err as one that retrying cannot fix, such as invalid input.
+// The task fails straight away, whatever the RetryPolicy for the status.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// RetryAfter marks err as transient and reschedules the task to run the
+// handlers for its status again once d has passed, instead of after the
+// backoff delay of its RetryPolicy.  The attempt still counts towards
+// MaxAttempts.
+func RetryAfter(err error, d time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &retryAfterError{err: err, after: d}
+}
+
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// retryPolicy returns the RetryPolicy that applies to a handler error at
+// status, and whether the error may be retried at all
+func (w *TaskWorkflow) retryPolicy(status string, err error) (RetryPolicy, bool) {
+	var permanent *permanentError
+	if errors.As(err, &permanent) {
+		return RetryPolicy{}, false
+	}
+
+	policy, defined := w.Retries[status]
+	if defined {
+		return policy, true
+	}
+
+	var retryable *retryableError
+	var retryAfter *retryAfterError
+	if errors.As(err, &retryable) || errors.As(err, &retryAfter) {
+		return DefaultRetryPolicy, true
+	}
+	return RetryPolicy{}, false
+}
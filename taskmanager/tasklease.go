@@ -0,0 +1,35 @@
+package taskmanager
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+)
+
+// ErrLeaseLost is returned when renewing the lease on a task that is no
+// longer claimed by this TaskManager, usually because the lease expired and
+// the task was reclaimed by another worker
+var ErrLeaseLost = errors.New("task lease lost")
+
+// newLeaseOwner identifies the process that claims a task, for locked_by
+func newLeaseOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+
+	return hostname + "-" + strconv.Itoa(os.Getpid()) + "-" + hex.EncodeToString(b)
+}
+
+// Heartbeat extends the lease on the task by the lease duration of its
+// TaskManager, set with WithLeaseDuration.  Handlers that may run longer than the lease should call it
+// regularly so that their task is not reclaimed by another worker.
+func (w *TaskWorkflow) Heartbeat() error {
+	m := w.GetTaskManager()
+	return m.store.RenewLease(w.Context, w.GetTask().Id, m.owner, m.leaseDuration())
+}
@@ -0,0 +1,155 @@
+package taskmanager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"time"
+)
+
+// HandlerRegistry binds the handler names used in workflow documents to Go
+// handlers.  NextStatus, EndWorkflow and WaitForNotify are always available
+// by name.
+type HandlerRegistry map[string]TaskWorkflowHandler
+
+var builtinHandlers = HandlerRegistry{
+	"NextStatus":    NextStatus,
+	"EndWorkflow":   EndWorkflow,
+	"WaitForNotify": WaitForNotify,
+}
+
+func (r HandlerRegistry) handler(name string) (TaskWorkflowHandler, bool) {
+	if h, registered := r[name]; registered {
+		return h, true
+	}
+	h, builtin := builtinHandlers[name]
+	return h, builtin
+}
+
+// taskWorkflowDocument is a workflow as written in YAML or JSON, e.g.
+//
+//	sequence: [Created, Active, Waiting, Complete]
+//	transitions:
+//	  Waiting: [Approved, Rejected]
+//	  Approved: []
+//	  Rejected: []
+//	waits: [Waiting]
+//	timeouts:
+//	  Active: 300
+//	retries:
+//	  Active: {maxAttempts: 3, baseDelay: 1s, maxDelay: 1m}
+//	handlers:
+//	  Created: [logCreated, NextStatus]
+type taskWorkflowDocument struct {
+	Sequence    []string                       `yaml:"sequence"`
+	Transitions map[string][]string            `yaml:"transitions"`
+	Waits       []string                       `yaml:"waits"`
+	Timeouts    map[string]int                 `yaml:"timeouts"`
+	Retries     map[string]retryPolicyDocument `yaml:"retries"`
+	Handlers    map[string][]string            `yaml:"handlers"`
+}
+
+// Delays are written as Go durations such as 500ms or 1m30s
+type retryPolicyDocument struct {
+	MaxAttempts int     `yaml:"maxAttempts"`
+	BaseDelay   string  `yaml:"baseDelay"`
+	Multiplier  float64 `yaml:"multiplier"`
+	Jitter      float64 `yaml:"jitter"`
+	MaxDelay    string  `yaml:"maxDelay"`
+}
+
+// LoadTaskWorkflow reads a workflow document in YAML or JSON and binds its
+// handler names to the handlers in registry.  It returns a *ValidationError
+// listing every unknown handler and invalid delay.
+func LoadTaskWorkflow(data []byte, registry HandlerRegistry) (TaskWorkflowDefinition, error) {
+	// YAML is a superset of JSON, so one decoder reads both
+	var doc taskWorkflowDocument
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(&doc)
+	if err != nil {
+		return nil, errors.New("error reading task workflow document: " + err.Error())
+	}
+
+	var problems []string
+
+	handlers := make(map[string][]TaskWorkflowHandler)
+	for _, status := range sortedKeys(doc.Handlers) {
+		for _, name := range doc.Handlers[status] {
+			h, registered := registry.handler(name)
+			if !registered {
+				problems = append(problems, "unknown handler '"+name+"' for status '"+status+"'")
+				continue
+			}
+			handlers[status] = append(handlers[status], h)
+		}
+	}
+
+	retries := make(map[string]RetryPolicy)
+	for _, status := range sortedKeys(doc.Retries) {
+		p := doc.Retries[status]
+		baseDelay, err := parseDocumentDuration(p.BaseDelay)
+		if err != nil {
+			problems = append(problems, "invalid baseDelay for status '"+status+"': "+err.Error())
+		}
+		maxDelay, err := parseDocumentDuration(p.MaxDelay)
+		if err != nil {
+			problems = append(problems, "invalid maxDelay for status '"+status+"': "+err.Error())
+		}
+		retries[status] = RetryPolicy{
+			MaxAttempts: p.MaxAttempts,
+			BaseDelay:   baseDelay,
+			Multiplier:  p.Multiplier,
+			Jitter:      p.Jitter,
+			MaxDelay:    maxDelay,
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+
+	return func(ctx context.Context) *TaskWorkflow {
+		// Every workflow gets its own copy of the definition
+		w := &TaskWorkflow{
+			Context:     ctx,
+			Sequence:    append([]string(nil), doc.Sequence...),
+			Timeouts:    make(map[string]int),
+			Handlers:    make(map[string][]TaskWorkflowHandler),
+			Transitions: make(map[string][]string),
+			Waits:       append([]string(nil), doc.Waits...),
+			Retries:     make(map[string]RetryPolicy),
+		}
+		for status, timeout := range doc.Timeouts {
+			w.Timeouts[status] = timeout
+		}
+		for status, h := range handlers {
+			w.Handlers[status] = append([]TaskWorkflowHandler(nil), h...)
+		}
+		for status, next := range doc.Transitions {
+			w.Transitions[status] = append([]string(nil), next...)
+		}
+		for status, p := range retries {
+			w.Retries[status] = p
+		}
+		return w
+	}, nil
+}
+
+// LoadTaskWorkflowFile reads a workflow document from a YAML or JSON file
+func LoadTaskWorkflowFile(path string, registry HandlerRegistry) (TaskWorkflowDefinition, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return LoadTaskWorkflow(data, registry)
+}
+
+func parseDocumentDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -8,20 +8,22 @@ import (
 	"fmt"
 	_ "github.com/lib/pq"
 	"log"
-	"reflect"
-	"runtime"
 	"strconv"
-	"strings"
+	"time"
 )
 
 type TaskManager struct {
 	Context       context.Context
 	DatabaseTable string
-	db            *sql.DB
-
-	//	DataUrl string
-	//	TaskTypeWorkflows map[string]TaskWorkflowDefinition
-
+	store         TaskStore
+	dataUrl       string
+	workflows     map[string]TaskWorkflowDefinition
+	logger        *log.Logger
+	clock         func() time.Time
+	catchUp       CatchUpPolicy
+	lease         time.Duration
+	owner         string
+	running       *runningTasks
 }
 
 func (m *TaskManager) Bytes() []byte {
@@ -36,206 +38,469 @@ func (m *TaskManager) String() string {
 
 type TaskWorkflowDefinition func(ctx context.Context) *TaskWorkflow
 
-func New(ctx context.Context, dataUrl string, workflows map[string]TaskWorkflowDefinition) TaskManager {
-	ctx = context.WithValue(ctx, ContextKey("taskManagerDataUrl"), dataUrl)
-	ctx = context.WithValue(ctx, ContextKey("taskWorkflows"), workflows)
-	return TaskManager{
-		Context: ctx,
+// New returns a TaskManager configured by opts, which must give it somewhere
+// to store tasks with WithDataURL, WithDB or WithStore.  It returns an error
+// wrapping ErrInvalidOption for invalid options, and a *ValidationError
+// listing every problem found in the workflow definitions.
+func New(opts ...Option) (*TaskManager, error) {
+	c := config{
+		ctx:       context.Background(),
+		workflows: make(map[string]TaskWorkflowDefinition),
+	}
+	for _, opt := range opts {
+		err := opt(&c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := validateWorkflows(c.ctx, c.workflows)
+	if err != nil {
+		return nil, err
 	}
+
+	store, err := c.taskStore()
+	if err != nil {
+		return nil, err
+	}
+
+	return &TaskManager{
+		Context:       c.ctx,
+		DatabaseTable: c.table,
+		store:         store,
+		dataUrl:       c.dataUrl,
+		workflows:     c.workflows,
+		logger:        c.logger,
+		clock:         c.clock,
+		catchUp:       c.catchUp,
+		lease:         c.lease,
+		owner:         newLeaseOwner(),
+		running:       newRunningTasks(),
+	}, nil
 }
 
+// Open connects to the database given with WithDataURL.  A TaskManager given
+// its database or TaskStore is already open.
 func (m *TaskManager) Open() error {
-	// Open Connection
-	db, err := sql.Open("postgres", m.Context.Value(ContextKey("taskManagerDataUrl")).(string))
+	if m.store != nil {
+		return nil
+	}
+	if m.dataUrl == "" {
+		return errors.New("error opening task manager: no data URL")
+	}
+
+	store, err := openTaskStore(m.dataUrl, m.DatabaseTable, m.logger)
 	if err != nil {
 		return err
 	}
 
-	m.db = db
+	m.store = store
 	return nil
 }
 
 func (m *TaskManager) Close() {
 	// Close Connection but ignore any errors
-	_ = m.db.Close()
+	_ = m.closeStore()
+}
+
+// closeStore closes the store unless it has not been opened or is already
+// closed
+func (m *TaskManager) closeStore() error {
+	if m.store == nil {
+		return nil
+	}
+	err := m.store.Close()
+
+	// A store opened from the data URL can be opened again by Open
+	if m.dataUrl != "" {
+		m.store = nil
+	}
+	return err
+}
+
+// context returns the Context used by the methods that are not given one
+func (m *TaskManager) context() context.Context {
+	if m.Context == nil {
+		return context.Background()
+	}
+	return m.Context
 }
 
 func (m *TaskManager) ValidTaskType(t string) bool {
-	workflows := m.Context.Value(ContextKey("taskWorkflows")).(map[string]TaskWorkflowDefinition)
-	_, defined := workflows[t]
+	_, defined := m.workflows[t]
 	return defined
 }
 
 func (m *TaskManager) StartTask(id int) error {
-	task, err := m.FindTask(id)
+	return m.StartTaskContext(m.context(), id)
+}
+
+// StartTaskContext is StartTask with a context that is passed on to the
+// TaskStore and to the TaskWorkflow of each handler
+func (m *TaskManager) StartTaskContext(ctx context.Context, id int) error {
+	task, err := m.FindTaskContext(ctx, id)
 	if err != nil {
-		return errors.New("error starting task while finding task ID " + strconv.Itoa(id) + ": " + err.Error())
+		return err
 	}
 
 	if !m.ValidTaskType(task.TaskType) {
-		return errors.New("error starting task: invalid task type: " + task.TaskType)
+		return newTaskError(task, "error starting task: %w: %s", ErrInvalidTaskType, task.TaskType)
 	}
 
-	//if task.Recurring {
-	//	if time.Now().Before(task.CreatedAt.Add(time.Duration(task.Timeout)*time.Second)) {
-	//		log.Println("cannot start task: recurring task " +strconv.Itoa(task.Id) + " has not timed out for next execution")
-	//		return nil
-	//	}
-	//}
-
-	// Create a Task Workflow Context
-	ctx := m.Context
-	ctx = context.WithValue(ctx, ContextKey("taskManager"), m)
-	ctx = context.WithValue(ctx, ContextKey("task"), task)
 	if task.Recurring {
-		ctx = context.WithValue(ctx, ContextKey("recurringTask"), task)
+		if m.now().Before(task.NextRunAt) {
+			m.println("cannot start task: recurring task " + strconv.Itoa(task.Id) +
+				" is not scheduled to run until " + task.NextRunAt.String())
+			return nil
+		}
 	}
 
-	workflows := m.Context.Value(ContextKey("taskWorkflows")).(map[string]TaskWorkflowDefinition)
-	w := workflows[task.TaskType](ctx)
+	if task.LockedBy != "" && time.Now().Before(task.LeaseExpiresAt) {
+		return newTaskError(task, "error starting task: %w: task has already been claimed", ErrInvalidState)
+	}
 
+	// A repeated or stale start leaves a task that has already moved on alone
 	if task.Status != "Created" {
-		errMessage := "invalid task state for StartTask(): " + task.Status +
-			".  Task must be in created state before startng"
-		m.handleTaskError(w, errMessage)
-		return errors.New(errMessage)
+		return newTaskError(task, "error starting task: %w: task must be in Created state before starting", ErrInvalidState)
 	}
 
-	statusHandlers := w.Handlers["Created"]
-	for i := range statusHandlers {
-		handlerName := runtime.FuncForPC(reflect.ValueOf(statusHandlers[i]).Pointer()).Name()
-		if strings.HasSuffix(handlerName, "NextStatus") {
-			err := m.incrementTaskStatus(w)
-			if err != nil {
-				log.Println(err)
-				return err
-			}
-			break
-		}
-		err := statusHandlers[i](w)
-		if err != nil {
-			errMessage := "error executing handlers for " + strconv.Itoa(i) + " with task " + strconv.Itoa(task.Id)
-			m.handleTaskError(w, err.Error())
-			return errors.New(errMessage)
-		}
+	// Claim the task so that no other process or worker starts it as well
+	claimed, err := m.store.ClaimTask(ctx, And(Eq("id", id), Eq("status", "Created")), m.owner, m.leaseDuration())
+	if errors.Is(err, sql.ErrNoRows) {
+		return newTaskError(task, "error starting task: %w: task has already been claimed", ErrInvalidState)
+	}
+	if err != nil {
+		return newTaskError(task, "error starting task while claiming task: %w", err)
 	}
 
-	return nil
+	return m.resumeTask(ctx, claimed)
 }
 
+// resumeTask runs the handlers for the current status of a task claimed with
+// ClaimTask, then releases the claim
+func (m *TaskManager) resumeTask(ctx context.Context, task Task) error {
+	return m.runClaimed(task.Id, func() error {
+		return m.executeStatusHandlers(m.newTaskWorkflow(ctx, task))
+	})
+}
+
+// releaseTask uses the TaskManager Context, so that a task is released even
+// when the context it ran with is done
+func (m *TaskManager) releaseTask(id int) {
+	err := m.store.ReleaseTask(m.context(), id, m.owner)
+	if err != nil {
+		m.println("Warning: could not release task "+strconv.Itoa(id)+":", err)
+	}
+}
+
+func (m *TaskManager) leaseDuration() time.Duration {
+	if m.lease > 0 {
+		return m.lease
+	}
+	return 5 * time.Minute
+}
+
+// NotifyTaskWaitStatusResult moves on a task in one of the Waits of its
+// workflow, advancing it for a "success" result or failing it for "error".  It
+// returns ErrInvalidState when the task is not in a wait status.
 func (m *TaskManager) NotifyTaskWaitStatusResult(id int, result string, message string) error {
-	t, err := m.FindTask(id)
+	return m.NotifyTaskWaitStatusResultContext(m.context(), id, result, message)
+}
+
+// NotifyTaskWaitStatusResultContext is NotifyTaskWaitStatusResult with a
+// context that is passed on to the TaskStore and to the TaskWorkflow of each
+// handler
+func (m *TaskManager) NotifyTaskWaitStatusResultContext(ctx context.Context, id int, result string, message string) error {
+	t, err := m.FindTaskContext(ctx, id)
 	if err != nil {
-		errMessage := fmt.Sprintf("error finding task ID %d.  Task must be created before executing workflow", id)
-		return errors.New(errMessage)
+		return err
+	}
+
+	if !m.ValidTaskType(t.TaskType) {
+		return newTaskError(t, "error notifying task: %w: %s", ErrInvalidTaskType, t.TaskType)
+	}
+
+	if result != "success" && result != "error" {
+		return newTaskError(t, "error notifying task: invalid result type %s", result)
+	}
+
+	// Only a task waiting for a result can be moved on by one, so that a late or
+	// duplicate notification cannot advance a task that has already moved on
+	if !m.newTaskWorkflow(ctx, t).isWait(t.Status) {
+		return newTaskError(t, "error notifying task: %w: task is not in a wait status", ErrInvalidState)
+	}
+
+	// Claim the task while its workflow runs so that it can be reclaimed if we fail
+	claimed, err := m.store.ClaimTask(ctx, And(Eq("id", id), Eq("status", t.Status)), m.owner, m.leaseDuration())
+	if errors.Is(err, sql.ErrNoRows) {
+		return newTaskError(t, "error notifying task: %w: task is claimed by another process", ErrInvalidState)
+	}
+	if err != nil {
+		return newTaskError(t, "error notifying task while claiming task: %w", err)
+	}
+
+	// Another notification may have moved the task on before we claimed it
+	if claimed.Version != t.Version {
+		m.releaseTask(id)
+		return newTaskError(claimed, "error notifying task: %w", ErrConcurrentModification)
+	}
+	t = claimed
+
+	return m.runClaimed(id, func() error {
+		w := m.newTaskWorkflow(ctx, t)
+
+		if result == "error" {
+			m.handleTaskError(w, message)
+			return nil
+		}
+		return m.incrementTaskStatus(w, message)
+	})
+}
+
+// workflowContext is done when the context passed to a TaskManager method is,
+// and looks up values there before looking in the TaskManager Context
+type workflowContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c workflowContext) Value(key interface{}) interface{} {
+	v := c.Context.Value(key)
+	if v != nil {
+		return v
 	}
+	return c.values.Value(key)
+}
 
+func (m *TaskManager) newTaskWorkflow(ctx context.Context, task Task) *TaskWorkflow {
 	// Create a Task Workflow Context
-	ctx := m.Context
+	ctx = workflowContext{Context: ctx, values: m.context()}
 	ctx = context.WithValue(ctx, ContextKey("taskManager"), m)
-	ctx = context.WithValue(ctx, ContextKey("task"), t)
+	ctx = context.WithValue(ctx, ContextKey("task"), task)
+	if task.Recurring {
+		ctx = context.WithValue(ctx, ContextKey("recurringTask"), task)
+	}
 
-	workflows := m.Context.Value(ContextKey("taskWorkflows")).(map[string]TaskWorkflowDefinition)
-	w := workflows[t.TaskType](ctx)
+	return m.workflows[task.TaskType](ctx)
+}
+
+// incrementTaskStatus moves the task to its next status, recording message in
+// the task history
+func (m *TaskManager) incrementTaskStatus(w *TaskWorkflow, message string) error {
+	task := w.GetTask()
 
-	switch result {
-	case "success":
-		return m.incrementTaskStatus(w)
-	case "error":
-		m.handleTaskError(w, message)
+	// There is nowhere to advance to from a status the workflow ends at
+	if w.isTerminal(task.Status) {
+		endTaskWorkflow(w)
 		return nil
-	default:
-		errMessage := "invalid result type " + result
-		log.Println(errMessage)
-		return errors.New(errMessage)
 	}
+
+	// A status with a single declared transition moves to it, and a status
+	// with several must choose one with GoTo
+	if next, declared := w.Transitions[task.Status]; declared {
+		if len(next) == 1 {
+			return m.transitionTaskStatus(w, next[0], message)
+		}
+		err := newTaskError(task, "%w: cannot advance from a status with %d declared transitions, use GoTo",
+			ErrInvalidState, len(next))
+		m.handleTaskError(w, err.Error())
+		return err
+	}
+
+	for i := 0; i < len(w.Sequence)-1; i++ {
+		if w.Sequence[i] == task.Status {
+			return m.transitionTaskStatus(w, w.Sequence[i+1], message)
+		}
+	}
+
+	// A status reached with GoTo has no next status unless it declares one
+	err := newTaskError(task, "%w: cannot advance from a status with no declared transitions that is not in Sequence",
+		ErrInvalidState)
+	m.handleTaskError(w, err.Error())
+	return err
 }
 
-func (m *TaskManager) incrementTaskStatus(w *TaskWorkflow) error {
+// goToTaskStatus moves the task to the status chosen by a handler with GoTo
+func (m *TaskManager) goToTaskStatus(w *TaskWorkflow, nextStatus string) error {
 	task := w.GetTask()
 
-	// If task status is last in sequence then somehow we got here in error
-	if w.Sequence[len(w.Sequence)-1] == task.Status {
-		errMessage := "invalid task workflow definition: EndWorkflow function expected after '" +
-			task.Status + "' handler execution"
-		m.handleTaskError(w, errMessage)
-		return errors.New(errMessage)
+	if !w.canTransition(task.Status, nextStatus) {
+		err := newTaskError(task, "%w: invalid task workflow transition to '%s'", ErrInvalidState, nextStatus)
+		m.handleTaskError(w, err.Error())
+		return err
 	}
 
-	// Otherwise we are not on the last status, so process
-	for i := range w.Sequence {
-		if w.Sequence[i] == task.Status {
-			status := task.Status
-			nextStatus := w.Sequence[i+1]
+	return m.transitionTaskStatus(w, nextStatus, "")
+}
 
-			// Update the Task State
-			task.Status = nextStatus
-			task.Timeout = w.Timeouts[nextStatus]
+func (m *TaskManager) transitionTaskStatus(w *TaskWorkflow, nextStatus string, message string) error {
+	task := w.GetTask()
+	status := task.Status
 
-			//  - update the cached version of the task
-			w.UpdateTask(task)
+	// Update the Task State
+	task.Status = nextStatus
+	task.Timeout = w.Timeouts[nextStatus]
+	task.Attempt = 0
 
-			//  - update the database version of the task
-			err := m.UpdateTask(task)
-			if err != nil {
-				errMessage := "error updating task ID " + strconv.Itoa(task.Id) + " with status '" + status + "' to new status '" + nextStatus + "'"
-				m.handleTaskError(w, err.Error())
-				return errors.New(errMessage)
-			}
+	//  - update the cached version of the task
+	w.UpdateTask(task)
+
+	//  - update the database version of the task, unless it has been moved on
+	//    by someone else since we read it
+	err := m.transitionTask(w.Context, task, status, message)
+	if errors.Is(err, ErrConcurrentModification) {
+		return &TaskError{TaskId: task.Id, Status: status, Err: err}
+	}
+	if err != nil {
+		m.handleTaskError(w, err.Error())
+		return &TaskError{
+			TaskId: task.Id,
+			Status: status,
+			Err:    fmt.Errorf("error updating task to new status '%s': %w", nextStatus, err),
+		}
+	}
+	task.Version++
+	w.UpdateTask(task)
+
+	// Call the nextStatus Handlers
+	return m.executeStatusHandlers(w)
+}
+
+// executeStatusHandlers runs the handlers for the current status of the task
+func (m *TaskManager) executeStatusHandlers(w *TaskWorkflow) error {
+	task := w.GetTask()
 
-			// Call the nextStatus Handlers
-			statusHandlers := w.Handlers[nextStatus]
-			for j := range statusHandlers {
-				handlerName := runtime.FuncForPC(reflect.ValueOf(statusHandlers[j]).Pointer()).Name()
-				if strings.HasSuffix(handlerName, "EndWorkflow") {
-					// Reset the task if it is a recurring task
-					if task.Recurring {
-						resetRecurringTask(w)
-					}
-					break
+	statusHandlers := w.Handlers[task.Status]
+	for i := range statusHandlers {
+		err := statusHandlers[i](w)
+		if err != nil {
+			// Handlers return a TaskAction to tell the workflow what to do next
+			var action *TaskAction
+			if errors.As(err, &action) {
+				switch action.action {
+				case continueAction:
+					continue
+				case advanceAction:
+					return m.incrementTaskStatus(w, "")
+				case goToAction:
+					return m.goToTaskStatus(w, action.status)
+				case waitAction:
+					return nil
+				case endAction:
+					endTaskWorkflow(w)
+					return nil
 				}
-				if strings.HasSuffix(handlerName, "NextStatus") {
-					err := m.incrementTaskStatus(w)
-					if err != nil {
-						return err
-					}
-					break
+			}
+
+			// Record the failed attempt, and retry if the workflow allows it
+			task.Attempt++
+			task.Failures = append(task.Failures, TaskFailure{
+				Status:   task.Status,
+				Attempt:  task.Attempt,
+				Message:  err.Error(),
+				FailedAt: m.now(),
+			})
+			w.UpdateTask(task)
+			policy, retry := w.retryPolicy(task.Status, err)
+			if retry && task.Attempt < policy.MaxAttempts {
+				updateErr := m.UpdateTaskContext(w.Context, task)
+				if errors.Is(updateErr, ErrConcurrentModification) {
+					return newTaskError(task, "error updating attempt: %w", updateErr)
 				}
-				err := statusHandlers[j](w)
-				if err != nil {
-					errMessage := "error executing handlers for status '" + nextStatus +
-						"' with task ID " + strconv.Itoa(task.Id)
-					task.Message = err.Error()
-					m.handleTaskError(w, err.Error())
-					return errors.New(errMessage)
+				if updateErr != nil {
+					m.handleTaskError(w, updateErr.Error())
+					return newTaskError(task, "error updating attempt: %w", updateErr)
 				}
+				task.Version++
+				w.UpdateTask(task)
+				return m.retryStatusHandlers(w, policy, err)
+			}
+
+			if retry && policy.MaxAttempts > 1 {
+				m.handleTaskDeadLetter(w, err.Error())
+				return newTaskError(task, "error executing handlers, retries exhausted: %w", err)
 			}
-			break
+			m.handleTaskError(w, err.Error())
+			return newTaskError(task, "error executing handlers: %w", err)
 		}
 	}
 
+	// The workflow ends at a terminal status whether or not its handlers
+	// return End
+	if w.isTerminal(task.Status) {
+		endTaskWorkflow(w)
+	}
 	return nil
 }
 
 func (m *TaskManager) handleTaskError(w *TaskWorkflow, message string) {
+	m.handleTaskFailure(w, "Error", message)
+}
+
+// handleTaskDeadLetter gives up on a task that has exhausted its retries
+func (m *TaskManager) handleTaskDeadLetter(w *TaskWorkflow, message string) {
 	task := w.GetTask()
+	message = "retries exhausted after " + strconv.Itoa(task.Attempt) +
+		" attempts with status '" + task.Status + "': " + message
+	m.handleTaskFailure(w, "DeadLetter", message)
+}
+
+func (m *TaskManager) handleTaskTimeout(w *TaskWorkflow) {
+	task := w.GetTask()
+	message := "task timed out after " + strconv.Itoa(task.Timeout) +
+		" seconds with status '" + task.Status + "'"
+	m.handleTaskFailure(w, "Timeout", message)
+}
+
+// handleTaskFailure moves the task to a failure status such as Error or
+// Timeout and runs the handlers for that status
+func (m *TaskManager) handleTaskFailure(w *TaskWorkflow, status string, message string) {
+	task := w.GetTask()
+	previousStatus := task.Status
 
 	// Update the Task State
-	task.Status = "Error"
+	task.Status = status
 	task.Message = message
 
 	//  - update the cached version of the task
 	w.UpdateTask(task)
 
 	//  - update the database version of the task
-	err := m.UpdateTask(task) // No need to handle error from Update (other than log it) since we are already here
+	err := m.transitionTask(w.Context, task, previousStatus, message)
+	if errors.Is(err, ErrConcurrentModification) {
+		// Someone else has moved the task on since we read it, so it has not failed
+		m.println("Warning: task "+strconv.Itoa(task.Id)+" was not moved to '"+status+"':", err)
+		return
+	}
+	if err != nil && w.Context.Err() != nil {
+		// The caller gave up before the task could fail, so leave it for a
+		// worker to resume from its previous status
+		m.println("Warning: task "+strconv.Itoa(task.Id)+" was not moved to '"+status+"':", err)
+		err = m.abandonTask(task.Id, 0)
+		if err != nil {
+			m.println("Warning: could not abandon task "+strconv.Itoa(task.Id)+":", err)
+		}
+		return
+	}
 	if err != nil {
-		log.Println(err)
+		m.println(err) // No need to handle error from Update (other than log it) since we are already here
+	} else {
+		task.Version++
+		w.UpdateTask(task)
 	}
 
-	errorHandlers := w.Handlers["Error"]
-	for i := range errorHandlers {
-		_ = errorHandlers[i](w)
+	failureHandlers := w.Handlers[status]
+	for i := range failureHandlers {
+		_ = failureHandlers[i](w)
+	}
+
+	// Clear a lease held for a retry or a shutdown, so that no worker reclaims
+	// the failed task and runs the handlers for its status again
+	if task.LockedBy != "" {
+		err = m.store.ReleaseTask(m.context(), task.Id, task.LockedBy)
+		if err != nil {
+			m.println("Warning: could not release task "+strconv.Itoa(task.Id)+":", err)
+		}
 	}
 
 	// Reset the task if it is a recurring task
@@ -244,18 +509,47 @@ func (m *TaskManager) handleTaskError(w *TaskWorkflow, message string) {
 	}
 }
 
+// endTaskWorkflow ends the workflow of a task, creating the next task in the
+// series of a recurring task
+func endTaskWorkflow(w *TaskWorkflow) {
+	if w.GetTask().Recurring {
+		resetRecurringTask(w)
+	}
+}
+
 func resetRecurringTask(w *TaskWorkflow) {
 	task := w.GetTask()
 
+	m := w.GetTaskManager()
+
 	// Update recurring task with cached reference Id
 	recurringTask := w.Context.Value(ContextKey("recurringTask")).(Task)
 	recurringTask.ReferenceId = task.ReferenceId
+	recurringTask.Timeout = w.Timeouts["Created"]
+	recurringTask.Message = ""
+	recurringTask.Attempt = 0
+	recurringTask.Failures = nil
+	recurringTask.LockedBy = ""
+	recurringTask.LeaseExpiresAt = time.Time{}
+
+	// Schedule the next run from now, or from this run when catching up on every missed run
+	from := m.now()
+	if m.catchUp == CatchUpRunAll && !recurringTask.NextRunAt.IsZero() {
+		from = recurringTask.NextRunAt
+	}
+	nextRunAt, err := recurringTask.nextRunAfter(from)
+	if err != nil {
+		m.println("Warning: could not reset recurring task "+
+			strconv.Itoa(task.Id)+":", err)
+		return
+	}
+	recurringTask.NextRunAt = nextRunAt
 
-	// Create next recurring task
-	m := w.GetTaskManager()
-	_, err := m.CreateTask(recurringTask)
+	// Create next recurring task with the TaskManager Context, so that the
+	// series goes on even when the context the run ended with is done
+	_, err = m.CreateTaskContext(m.context(), recurringTask)
 	if err != nil {
-		log.Println("Warning: could not reset recurring task "+
+		m.println("Warning: could not reset recurring task "+
 			strconv.Itoa(task.Id)+":", err)
 	}
 }
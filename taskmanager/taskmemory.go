@@ -0,0 +1,442 @@
+package taskmanager
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryTaskStore struct {
+	mu     sync.Mutex
+	lastId int
+	tasks  map[int]Task
+
+	lastHistoryId int
+	history       []TaskTransition
+}
+
+// NewMemoryTaskStore returns a goroutine-safe TaskStore that keeps every
+// task in memory.  It follows the same semantics as the SQL store and is
+// intended for unit tests and embedded use.
+func NewMemoryTaskStore() TaskStore {
+	return &memoryTaskStore{
+		tasks: make(map[int]Task),
+	}
+}
+
+func (s *memoryTaskStore) CreateTask(ctx context.Context, t Task) (Task, error) {
+	err := ctx.Err()
+	if err != nil {
+		return Task{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastId++
+	t.Id = s.lastId
+	t.Version = 1
+
+	// Like the SQL INSERT, a new task is never locked
+	t.LockedBy = ""
+	t.LeaseExpiresAt = time.Time{}
+
+	t.CreatedAt = time.Now()
+	t.UpdatedAt = t.CreatedAt
+	t.StatusChangedAt = t.CreatedAt
+	s.tasks[t.Id] = copyTask(t)
+
+	return t, nil
+}
+
+func (s *memoryTaskStore) CountAllTasks(ctx context.Context) (int, error) {
+	err := ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.tasks), nil
+}
+
+func (s *memoryTaskStore) FindAllTasks(ctx context.Context, options *FindOptions) ([]Task, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	err = options.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	where := options.Predicate()
+	var result []Task
+	for _, t := range s.tasks {
+		if where.Match(t) {
+			result = append(result, copyTask(t))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Id < result[j].Id
+	})
+
+	return applyFindOptions(result, options), nil
+}
+
+func (s *memoryTaskStore) FindTask(ctx context.Context, id int) (Task, error) {
+	err := ctx.Err()
+	if err != nil {
+		return Task{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tasks[id]
+	if !ok {
+		return Task{}, sql.ErrNoRows
+	}
+	return copyTask(t), nil
+}
+
+func (s *memoryTaskStore) UpdateTask(ctx context.Context, t Task) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.updateTask(t)
+}
+
+func (s *memoryTaskStore) TransitionTask(ctx context.Context, t Task, h TaskTransition) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = s.updateTask(t)
+	if err != nil {
+		return err
+	}
+	s.addTaskHistory(h)
+	return nil
+}
+
+func (s *memoryTaskStore) updateTask(t Task) error {
+	// Like the SQL UPDATE, a task that has a different version is not updated
+	existing, ok := s.tasks[t.Id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if existing.Version != t.Version {
+		return ErrConcurrentModification
+	}
+
+	t.Version++
+	t.LockedBy = existing.LockedBy
+	t.LeaseExpiresAt = existing.LeaseExpiresAt
+	t.CreatedAt = existing.CreatedAt
+	t.UpdatedAt = time.Now()
+	t.StatusChangedAt = existing.StatusChangedAt
+	if t.Status != existing.Status {
+		t.StatusChangedAt = t.UpdatedAt
+	}
+	s.tasks[t.Id] = copyTask(t)
+	return nil
+}
+
+func (s *memoryTaskStore) DeleteTask(ctx context.Context, id int) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.tasks[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	delete(s.tasks, id)
+	return nil
+}
+
+func (s *memoryTaskStore) ClaimTask(ctx context.Context, where *Predicate, owner string, lease time.Duration) (Task, error) {
+	err := ctx.Err()
+	if err != nil {
+		return Task{}, err
+	}
+
+	err = where.Validate()
+	if err != nil {
+		return Task{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Only claim tasks that are not locked or whose lease has expired
+	now := time.Now()
+	where = And(where, Or(IsNull("lease_expires_at"), Lt("lease_expires_at", now)))
+
+	claimed := Task{}
+	for _, t := range s.tasks {
+		if where.Match(t) && (claimed.Id == 0 || t.Id < claimed.Id) {
+			claimed = t
+		}
+	}
+	if claimed.Id == 0 {
+		return Task{}, sql.ErrNoRows
+	}
+
+	claimed.LockedBy = owner
+	claimed.LeaseExpiresAt = now.Add(lease)
+	claimed.UpdatedAt = now
+	s.tasks[claimed.Id] = claimed
+	return copyTask(claimed), nil
+}
+
+func (s *memoryTaskStore) RenewLease(ctx context.Context, id int, owner string, lease time.Duration) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tasks[id]
+	if !ok || t.LockedBy != owner {
+		return ErrLeaseLost
+	}
+
+	t.LeaseExpiresAt = time.Now().Add(lease)
+	t.UpdatedAt = time.Now()
+	s.tasks[id] = t
+	return nil
+}
+
+func (s *memoryTaskStore) ReleaseTask(ctx context.Context, id int, owner string) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tasks[id]
+	if !ok || t.LockedBy != owner {
+		return nil
+	}
+
+	t.LockedBy = ""
+	t.LeaseExpiresAt = time.Time{}
+	t.UpdatedAt = time.Now()
+	s.tasks[id] = t
+	return nil
+}
+
+func (s *memoryTaskStore) Close() error {
+	return nil
+}
+
+func (s *memoryTaskStore) addTaskHistory(h TaskTransition) {
+	s.lastHistoryId++
+	h.Id = s.lastHistoryId
+	h.CreatedAt = time.Now()
+	s.history = append(s.history, h)
+}
+
+func (s *memoryTaskStore) FindTaskHistory(ctx context.Context, taskId int) ([]TaskTransition, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []TaskTransition
+	for _, h := range s.history {
+		if h.TaskId == taskId {
+			result = append(result, h)
+		}
+	}
+	return result, nil
+}
+
+// applyFindOptions sorts and pages tasks held in memory the same way
+// FindOptions.sql does for the SQL stores
+func applyFindOptions(tasks []Task, options *FindOptions) []Task {
+	if options == nil {
+		return tasks
+	}
+
+	if options.SortColumn != "" {
+		column := options.SortColumn
+		descending := options.descending()
+		sort.SliceStable(tasks, func(i, j int) bool {
+			a, _ := taskColumnValue(tasks[i], column)
+			b, _ := taskColumnValue(tasks[j], column)
+			c, _ := compareColumnValue(a, b)
+			if descending {
+				return c > 0
+			}
+			return c < 0
+		})
+	}
+
+	if options.Offset > 0 {
+		if options.Offset > len(tasks) {
+			return nil
+		}
+		tasks = tasks[options.Offset:]
+	}
+	if options.Limit > 0 && options.Limit < len(tasks) {
+		tasks = tasks[:options.Limit]
+	}
+
+	return tasks
+}
+
+// taskColumnValue returns the value of t stored under the named task_manager
+// column, or nil when the column would be NULL
+func taskColumnValue(t Task, column string) (interface{}, bool) {
+	switch column {
+	case "id":
+		return t.Id, true
+	case "version":
+		return t.Version, true
+	case "reference_id":
+		return t.ReferenceId, true
+	case "task_group":
+		return t.TaskGroup, true
+	case "task_type":
+		return t.TaskType, true
+	case "recurring":
+		return t.Recurring, true
+	case "status":
+		return t.Status, true
+	case "timeout":
+		return t.Timeout, true
+	case "message":
+		return t.Message, true
+	case "properties":
+		return string(t.Properties), true
+	case "schedule":
+		return t.Schedule, true
+	case "recurrence_interval":
+		return t.RecurrenceInterval, true
+	case "next_run_at":
+		return nullableTime(t.NextRunAt), true
+	case "attempt":
+		return t.Attempt, true
+	case "failures":
+		failures := sqlNullFailures(t.Failures)
+		if !failures.Valid {
+			return nil, true
+		}
+		return failures.String, true
+	case "locked_by":
+		if t.LockedBy == "" {
+			return nil, true
+		}
+		return t.LockedBy, true
+	case "lease_expires_at":
+		return nullableTime(t.LeaseExpiresAt), true
+	case "created_at":
+		return t.CreatedAt, true
+	case "updated_at":
+		return t.UpdatedAt, true
+	case "status_changed_at":
+		return t.StatusChangedAt, true
+	default:
+		return nil, false
+	}
+}
+
+// compareColumnValue orders two column values of the same type, returning
+// false when they cannot be compared
+func compareColumnValue(a interface{}, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case int:
+		b, ok := b.(int)
+		switch {
+		case !ok:
+			return 0, false
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		default:
+			return 0, true
+		}
+	case bool:
+		b, ok := b.(bool)
+		switch {
+		case !ok:
+			return 0, false
+		case a == b:
+			return 0, true
+		case b:
+			return -1, true
+		default:
+			return 1, true
+		}
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a, b), true
+	case time.Time:
+		b, ok := b.(time.Time)
+		switch {
+		case !ok:
+			return 0, false
+		case a.Before(b):
+			return -1, true
+		case a.After(b):
+			return 1, true
+		default:
+			return 0, true
+		}
+	default:
+		return 0, false
+	}
+}
+
+// nullableTime treats the zero time as NULL, just as the SQL stores do
+func nullableTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+func copyTask(t Task) Task {
+	if t.Properties != nil {
+		t.Properties = append([]byte(nil), t.Properties...)
+	}
+	if t.Failures != nil {
+		t.Failures = append([]TaskFailure(nil), t.Failures...)
+	}
+	return t
+}
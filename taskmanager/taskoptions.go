@@ -0,0 +1,179 @@
+package taskmanager
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// FindFilter matches tasks whose Column starts with Value, ignoring case
+type FindFilter struct {
+	Column string
+	Value  string
+}
+
+// FindOptions narrows, orders and pages the results of the FindAll* methods.
+// Column names are checked against the task_manager columns and every value
+// is bound as a query parameter, so options may safely come from user input.
+// A nil *FindOptions applies no options at all.
+type FindOptions struct {
+	// Where and Filters are combined with AND
+	Where   *Predicate
+	Filters []FindFilter
+
+	SortColumn string
+	SortOrder  string // "ASC" or "DESC", defaults to "ASC"
+
+	// A Limit of 0 returns every remaining task
+	Limit  int
+	Offset int
+}
+
+// ParseFindOptions converts the filterColumn, filterValue, sortColumn,
+// sortOrder, rangeStart and rangeEnd keys used by earlier versions of the
+// FindAll* methods into FindOptions
+func ParseFindOptions(options map[string]string) (*FindOptions, error) {
+	if options == nil {
+		return nil, nil
+	}
+
+	var o FindOptions
+	if options["filterColumn"] != "" && options["filterValue"] != "" {
+		o.Filters = append(o.Filters, FindFilter{
+			Column: options["filterColumn"],
+			Value:  options["filterValue"],
+		})
+	}
+	if options["sortColumn"] != "" && options["sortOrder"] != "" {
+		o.SortColumn = options["sortColumn"]
+		o.SortOrder = options["sortOrder"]
+	}
+	if options["rangeStart"] != "" && options["rangeEnd"] != "" {
+		rangeStart, err := strconv.Atoi(options["rangeStart"])
+		if err != nil {
+			return nil, errors.New("invalid find option rangeStart: " + options["rangeStart"])
+		}
+		rangeEnd, err := strconv.Atoi(options["rangeEnd"])
+		if err != nil {
+			return nil, errors.New("invalid find option rangeEnd: " + options["rangeEnd"])
+		}
+		if rangeEnd <= rangeStart {
+			return nil, errors.New("invalid find option range: rangeEnd must be greater than rangeStart")
+		}
+
+		o.Offset = rangeStart
+		o.Limit = rangeEnd - rangeStart
+	}
+
+	err := o.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+func (o *FindOptions) Validate() error {
+	if o == nil {
+		return nil
+	}
+
+	err := o.Where.Validate()
+	if err != nil {
+		return err
+	}
+	for i := range o.Filters {
+		if !validTaskColumn(o.Filters[i].Column) {
+			return errors.New("invalid find option filter column: " + o.Filters[i].Column)
+		}
+	}
+	if o.SortColumn != "" && !validTaskColumn(o.SortColumn) {
+		return errors.New("invalid find option sort column: " + o.SortColumn)
+	}
+	if o.SortOrder != "" && !strings.EqualFold(o.SortOrder, "ASC") && !strings.EqualFold(o.SortOrder, "DESC") {
+		return errors.New("invalid find option sort order: " + o.SortOrder)
+	}
+	if o.Limit < 0 {
+		return errors.New("invalid find option limit: " + strconv.Itoa(o.Limit))
+	}
+	if o.Offset < 0 {
+		return errors.New("invalid find option offset: " + strconv.Itoa(o.Offset))
+	}
+
+	return nil
+}
+
+func (o *FindOptions) descending() bool {
+	return strings.EqualFold(o.SortOrder, "DESC")
+}
+
+// where returns a copy of the options that also requires p to match
+func (o *FindOptions) where(p *Predicate) *FindOptions {
+	var result FindOptions
+	if o != nil {
+		result = *o
+	}
+	result.Where = And(p, result.Where)
+	return &result
+}
+
+// Predicate combines Where and Filters into the single Predicate a task must
+// match, or nil when every task matches
+func (o *FindOptions) Predicate() *Predicate {
+	if o == nil {
+		return nil
+	}
+
+	predicates := []*Predicate{o.Where}
+	for i := range o.Filters {
+		predicates = append(predicates, Prefix(o.Filters[i].Column, o.Filters[i].Value))
+	}
+	return And(predicates...)
+}
+
+// sql renders the options as a query suffix with parameters numbered from $1
+func (o *FindOptions) sql() (string, []interface{}, error) {
+	err := o.Validate()
+	if err != nil || o == nil {
+		return "", nil, err
+	}
+
+	query := ""
+	var args []interface{}
+	param := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if p := o.Predicate(); p != nil {
+		query += " WHERE " + p.sql(param)
+	}
+	if o.SortColumn != "" {
+		query += " ORDER BY " + o.SortColumn
+		if o.descending() {
+			query += " DESC"
+		}
+	}
+	if o.Limit > 0 {
+		query += " LIMIT " + param(o.Limit)
+	} else if o.Offset > 0 {
+		query += " LIMIT ALL"
+	}
+	if o.Offset > 0 {
+		query += " OFFSET " + param(o.Offset)
+	}
+
+	return query, args, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func validTaskColumn(column string) bool {
+	for _, c := range strings.Split(sqlTaskReadColumns, ",") {
+		if strings.TrimSpace(c) == column {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,204 @@
+package taskmanager
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Predicate is a condition on task columns built with Eq, Prefix, Lt, Le,
+// Gt, Ge, IsNull, And and Or.  Predicates are rendered as parameterized SQL by the
+// SQL stores and evaluated directly by the memory store.  Values may be an
+// int, string, bool or time.Time.
+//
+// A TaskStore outside this package can inspect a predicate with Op, Column,
+// Value and Operands to translate it for its backend, or evaluate it against
+// a task with Match.
+type Predicate struct {
+	op       string
+	column   string
+	value    interface{}
+	operands []*Predicate
+}
+
+func Eq(column string, value interface{}) *Predicate {
+	return &Predicate{op: "=", column: column, value: value}
+}
+
+// Prefix matches a column that starts with value, ignoring case
+func Prefix(column string, value string) *Predicate {
+	return &Predicate{op: "prefix", column: column, value: value}
+}
+
+func Lt(column string, value interface{}) *Predicate {
+	return &Predicate{op: "<", column: column, value: value}
+}
+
+func Le(column string, value interface{}) *Predicate {
+	return &Predicate{op: "<=", column: column, value: value}
+}
+
+func Gt(column string, value interface{}) *Predicate {
+	return &Predicate{op: ">", column: column, value: value}
+}
+
+func Ge(column string, value interface{}) *Predicate {
+	return &Predicate{op: ">=", column: column, value: value}
+}
+
+func IsNull(column string) *Predicate {
+	return &Predicate{op: "null", column: column}
+}
+
+// And matches when every predicate matches.  Nil predicates are ignored.
+func And(predicates ...*Predicate) *Predicate {
+	return combinePredicates("AND", predicates)
+}
+
+// Or matches when any predicate matches.  Nil predicates are ignored.
+func Or(predicates ...*Predicate) *Predicate {
+	return combinePredicates("OR", predicates)
+}
+
+func combinePredicates(op string, predicates []*Predicate) *Predicate {
+	var operands []*Predicate
+	for _, p := range predicates {
+		if p != nil {
+			operands = append(operands, p)
+		}
+	}
+
+	switch len(operands) {
+	case 0:
+		return nil
+	case 1:
+		return operands[0]
+	default:
+		return &Predicate{op: op, operands: operands}
+	}
+}
+
+// Op returns the operator of the predicate: "=", "<", "<=", ">", ">=",
+// "prefix" or "null" for a condition on Column, or "AND" or "OR" for a
+// combination of Operands
+func (p *Predicate) Op() string {
+	return p.op
+}
+
+// Column returns the task column a condition tests, or "" for AND and OR
+func (p *Predicate) Column() string {
+	return p.column
+}
+
+// Value returns the value a condition compares Column with, or nil for
+// "null", AND and OR
+func (p *Predicate) Value() interface{} {
+	return p.value
+}
+
+// Operands returns the predicates combined by AND or OR, or nil for a
+// condition
+func (p *Predicate) Operands() []*Predicate {
+	return p.operands
+}
+
+func (p *Predicate) Validate() error {
+	if p == nil {
+		return nil
+	}
+
+	switch p.op {
+	case "AND", "OR":
+		for _, operand := range p.operands {
+			err := operand.Validate()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !validTaskColumn(p.column) {
+		return errors.New("invalid predicate column: " + p.column)
+	}
+	if p.op == "null" {
+		return nil
+	}
+	switch p.value.(type) {
+	case int, string, bool, time.Time:
+		return nil
+	default:
+		return fmt.Errorf("invalid predicate value for column %s: unsupported type %T", p.column, p.value)
+	}
+}
+
+// sql renders the predicate, binding each value through param
+func (p *Predicate) sql(param func(v interface{}) string) string {
+	switch p.op {
+	case "AND", "OR":
+		var operands []string
+		for _, operand := range p.operands {
+			operands = append(operands, operand.sql(param))
+		}
+		return "(" + strings.Join(operands, " "+p.op+" ") + ")"
+	case "null":
+		return p.column + " IS NULL"
+	case "prefix":
+		return p.column + " ILIKE " + param(escapeLike(fmt.Sprint(p.value))+"%") + ` ESCAPE '\'`
+	default:
+		return p.column + " " + p.op + " " + param(p.value)
+	}
+}
+
+// Match evaluates the predicate against a task held in memory.  A nil
+// predicate matches every task.
+func (p *Predicate) Match(t Task) bool {
+	if p == nil {
+		return true
+	}
+
+	switch p.op {
+	case "AND":
+		for _, operand := range p.operands {
+			if !operand.Match(t) {
+				return false
+			}
+		}
+		return true
+	case "OR":
+		for _, operand := range p.operands {
+			if operand.Match(t) {
+				return true
+			}
+		}
+		return false
+	}
+
+	value, _ := taskColumnValue(t, p.column)
+	if p.op == "null" {
+		return value == nil
+	}
+	if p.op == "prefix" {
+		return strings.HasPrefix(strings.ToLower(fmt.Sprint(value)), strings.ToLower(fmt.Sprint(p.value)))
+	}
+
+	c, ok := compareColumnValue(value, p.value)
+	if !ok {
+		return false
+	}
+	switch p.op {
+	case "=":
+		return c == 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	default:
+		return false
+	}
+}
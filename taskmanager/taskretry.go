@@ -0,0 +1,89 @@
+package taskmanager
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy decides how often, and after how long, the handlers for a
+// status are run again after one of them returns an error.  A failed attempt
+// is rescheduled rather than waited for, and a Worker makes the retry once
+// the delay has passed.
+type RetryPolicy struct {
+	// The number of times the handlers are run, including the first.  A
+	// MaxAttempts of 1 or less never retries.
+	MaxAttempts int `json:"maxAttempts"`
+
+	// The delay before the first retry, multiplied by Multiplier (2 if zero)
+	// for each retry after that
+	BaseDelay  time.Duration `json:"baseDelay"`
+	Multiplier float64       `json:"multiplier"`
+
+	// The fraction of the delay, from 0 to 1, that is randomly added or
+	// subtracted so that failing tasks do not all retry at the same time
+	Jitter float64 `json:"jitter"`
+
+	// The longest delay between retries, if above 0
+	MaxDelay time.Duration `json:"maxDelay"`
+}
+
+// DefaultRetryPolicy retries errors marked Retryable or RetryAfter in
+// statuses without a RetryPolicy of their own
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   time.Second,
+	Multiplier:  2,
+	Jitter:      0.1,
+	MaxDelay:    time.Minute,
+}
+
+// Delay returns the backoff delay before retrying after failed attempt n,
+// starting from 1
+func (p RetryPolicy) Delay(n int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	delay := float64(p.BaseDelay) * math.Pow(multiplier, float64(n-1))
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return time.Duration(delay)
+}
+
+// retryStatusHandlers reschedules the current status of a task after a failed
+// attempt, holding the lease for the backoff delay, or the delay given to
+// RetryAfter, and then leaving the task for a Worker to reclaim and run the
+// handlers for the status again.  The calling StartTask or
+// NotifyTaskWaitStatusResult returns without waiting for the retry.
+func (m *TaskManager) retryStatusHandlers(w *TaskWorkflow, policy RetryPolicy, cause error) error {
+	task := w.GetTask()
+
+	delay := policy.Delay(task.Attempt)
+	var retryAfter *retryAfterError
+	if errors.As(cause, &retryAfter) {
+		delay = retryAfter.after
+	}
+	m.println("Task Retry: task "+strconv.Itoa(task.Id)+" failed attempt "+strconv.Itoa(task.Attempt)+
+		" of "+strconv.Itoa(policy.MaxAttempts)+" with status '"+task.Status+"', rescheduled in "+delay.String()+":", cause)
+
+	// Hold the lease until the task is due, then leave it for a worker to reclaim
+	err := m.abandonTask(task.Id, delay)
+	if err != nil {
+		return newTaskError(task, "error rescheduling task: %w", err)
+	}
+	return nil
+}
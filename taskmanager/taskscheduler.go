@@ -0,0 +1,118 @@
+package taskmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"strconv"
+	"time"
+)
+
+// CatchUpPolicy decides what the scheduler does with a recurring task that
+// missed one or more runs, for example while no scheduler was running
+type CatchUpPolicy int
+
+const (
+	// CatchUpRunOnce runs the task once and schedules the next run from now
+	CatchUpRunOnce CatchUpPolicy = iota
+
+	// CatchUpSkip drops the missed runs and schedules the next run from now
+	CatchUpSkip
+
+	// CatchUpRunAll runs the task once for every missed run
+	CatchUpRunAll
+)
+
+// Schedules are standard 5 field cron expressions with an optional leading
+// seconds field, descriptors such as @daily, and an optional CRON_TZ= or TZ=
+// time zone prefix, e.g. "CRON_TZ=UTC 0 2 * * 1-5"
+var cronParser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour |
+	cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// nextRunAfter returns the first time after from that a recurring task should
+// run, following its Schedule if it has one and its RecurrenceInterval if not.
+// A task with neither would run again on every tick of the scheduler, so it is
+// an ErrInvalidState.
+func (t Task) nextRunAfter(from time.Time) (time.Time, error) {
+	if t.Schedule == "" {
+		if t.RecurrenceInterval <= 0 {
+			return time.Time{}, fmt.Errorf("%w: recurring task needs a Schedule or a RecurrenceInterval above 0", ErrInvalidState)
+		}
+		return from.Add(time.Duration(t.RecurrenceInterval) * time.Second), nil
+	}
+
+	schedule, err := cronParser.Parse(t.Schedule)
+	if err != nil {
+		return time.Time{}, errors.New("invalid schedule '" + t.Schedule + "' for recurring task: " + err.Error())
+	}
+	return schedule.Next(from), nil
+}
+
+// ScheduleRecurringTasks starts every recurring task in the Created status
+// whose NextRunAt has passed.  When a recurring task ends, the next task in
+// the series is created to run at the next time given by its Schedule or
+// RecurrenceInterval.  Missed runs are handled according to WithCatchUp.
+func (m *TaskManager) ScheduleRecurringTasks() error {
+	return m.ScheduleRecurringTasksContext(m.context())
+}
+
+func (m *TaskManager) ScheduleRecurringTasksContext(ctx context.Context) error {
+	tasks, err := m.FindAllRecurringTasksContext(ctx, &FindOptions{Where: Eq("status", "Created")})
+	if err != nil {
+		return err
+	}
+
+	now := m.now()
+	for _, task := range tasks {
+		if now.Before(task.NextRunAt) {
+			continue
+		}
+
+		if m.catchUp == CatchUpSkip && !task.NextRunAt.IsZero() {
+			// The task has missed at least one run if its following run is also due
+			following, err := task.nextRunAfter(task.NextRunAt)
+			if err != nil {
+				m.println("error scheduling recurring task "+strconv.Itoa(task.Id)+":", err)
+				continue
+			}
+			if !now.Before(following) {
+				task.NextRunAt, _ = task.nextRunAfter(now)
+				err := m.UpdateTaskContext(ctx, task)
+				if err != nil {
+					m.println("error skipping missed runs of recurring task "+strconv.Itoa(task.Id)+":", err)
+				}
+				continue
+			}
+		}
+
+		err := m.StartTaskContext(ctx, task.Id)
+		if err != nil {
+			m.println("error starting recurring task "+strconv.Itoa(task.Id)+":", err)
+		}
+	}
+
+	return nil
+}
+
+// RunScheduler calls ScheduleRecurringTasksContext with ctx every interval
+// until ctx is done or the TaskManager is shut down
+func (m *TaskManager) RunScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := m.ScheduleRecurringTasksContext(ctx)
+		if err != nil {
+			m.println("error scheduling recurring tasks:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.running.shuttingDown():
+			return
+		case <-ticker.C:
+		}
+	}
+}
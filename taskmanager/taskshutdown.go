@@ -0,0 +1,193 @@
+package taskmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// runningTasks tracks the claimed tasks whose handlers are running so that
+// Shutdown can wait for them
+type runningTasks struct {
+	mu        sync.Mutex
+	wg        sync.WaitGroup
+	ids       map[int]int
+	abandoned map[int]bool
+	stopping  chan struct{}
+	stopped   bool
+}
+
+func newRunningTasks() *runningTasks {
+	return &runningTasks{
+		ids:       make(map[int]int),
+		abandoned: make(map[int]bool),
+		stopping:  make(chan struct{}),
+	}
+}
+
+// add registers a running task, returning false once Shutdown has been called
+func (r *runningTasks) add(id int) bool {
+	if r == nil {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped {
+		return false
+	}
+	r.ids[id]++
+	r.wg.Add(1)
+	return true
+}
+
+func (r *runningTasks) done(id int) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ids[id]--
+	if r.ids[id] == 0 {
+		delete(r.ids, id)
+	}
+	r.wg.Done()
+}
+
+// abandon marks a running task whose lease has been expired for another
+// worker, and reports whether it was still running
+func (r *runningTasks) abandon(id int) bool {
+	if r == nil {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.ids[id] == 0 {
+		return false
+	}
+	r.abandoned[id] = true
+	return true
+}
+
+// release reports whether a task that has finished running should be
+// released, forgetting that it was abandoned
+func (r *runningTasks) release(id int) bool {
+	if r == nil {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.abandoned[id] {
+		delete(r.abandoned, id)
+		return false
+	}
+	return true
+}
+
+func (r *runningTasks) running() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ids []int
+	for id := range r.ids {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (r *runningTasks) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.stopped {
+		r.stopped = true
+		close(r.stopping)
+	}
+}
+
+// shuttingDown returns a channel that is closed once Shutdown has been called,
+// or a nil channel for a TaskManager that was not created with New
+func (r *runningTasks) shuttingDown() <-chan struct{} {
+	if r == nil {
+		return nil
+	}
+	return r.stopping
+}
+
+// runClaimed runs fn for a task claimed by m, tracking it for Shutdown and
+// releasing the claim once fn returns
+func (m *TaskManager) runClaimed(id int, fn func() error) error {
+	if !m.running.add(id) {
+		m.releaseTask(id)
+		return &TaskError{TaskId: id, Err: errors.New("error running task: task manager is shutting down")}
+	}
+	defer m.running.done(id)
+	defer func() {
+		if m.running.release(id) {
+			m.releaseTask(id)
+		}
+	}()
+
+	return fn()
+}
+
+// Shutdown stops workers, schedulers and sweepers from starting new work,
+// refuses new calls to StartTask and NotifyTaskWaitStatusResult, and waits for
+// the handlers that are already running.  If ctx is done first, the leases on
+// the unfinished tasks are expired so that any worker can resume them from
+// their current status straight away.  The store is closed in either case.
+func (m *TaskManager) Shutdown(ctx context.Context) error {
+	if m.running == nil {
+		return m.closeStore()
+	}
+
+	m.running.stop()
+
+	finished := make(chan struct{})
+	go func() {
+		m.running.wg.Wait()
+		close(finished)
+	}()
+
+	var result error
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		unfinished := m.running.running()
+		for _, id := range unfinished {
+			err := m.abandonTask(id, 0)
+			if err != nil && !errors.Is(err, ErrLeaseLost) && result == nil {
+				result = fmt.Errorf("error releasing task ID %d during shutdown: %w", id, err)
+			}
+		}
+		if result == nil {
+			result = fmt.Errorf("error shutting down task manager with %d tasks still running: %w", len(unfinished), ctx.Err())
+		}
+	}
+
+	err := m.closeStore()
+	if err != nil && result == nil {
+		result = err
+	}
+	return result
+}
+
+// abandonTask sets the lease on a running task to expire after d, and keeps it
+// from being released when its handlers return, so that another worker can
+// resume it from its current status once the lease expires.  A d of zero
+// expires the lease straight away.
+func (m *TaskManager) abandonTask(id int, d time.Duration) error {
+	if !m.running.abandon(id) {
+		return nil
+	}
+	return m.store.RenewLease(m.context(), id, m.owner, d)
+}
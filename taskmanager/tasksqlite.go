@@ -0,0 +1,131 @@
+package taskmanager
+
+import (
+	"database/sql"
+	"github.com/mattn/go-sqlite3"
+	"strings"
+)
+
+const sqliteDriverName = "sqlite3"
+
+// sqliteTimestamp keeps millisecond precision, unlike CURRENT_TIMESTAMP, and
+// sqliteTimestampFormat is the equivalent Go time layout
+const sqliteTimestamp = `(strftime('%Y-%m-%d %H:%M:%f', 'now'))`
+const sqliteTimestampFormat = "2006-01-02 15:04:05.000"
+
+func sqliteCreateTaskTable(t string) string {
+	t = sqlQueryTaskTable(t)
+
+	// A trigger is created in the schema of its table, and names the table
+	// without its schema
+	schema, table := "", t
+	if i := strings.LastIndex(t, "."); i >= 0 {
+		schema, table = t[:i+1], t[i+1:]
+	}
+
+	return `
+        CREATE TABLE IF NOT EXISTS ` + t + `
+        (
+            -- Primary Key
+            id           integer primary key autoincrement,
+
+            -- Record Version
+            version      integer default 1,
+
+            -- Task Reference Id
+            reference_id varchar(20),
+
+            -- Task Metadata
+            task_group   varchar(20),
+            task_type    varchar(20),
+            recurring    boolean,
+            status       varchar(20),
+            timeout      integer,
+            message      varchar(512),
+            properties   blob,
+
+            -- Recurring Task Schedule
+            schedule     varchar(100),
+            recurrence_interval integer,
+            next_run_at  timestamp,
+
+            -- Task Retries
+            attempt      integer default 0,
+            failures     text,
+
+            -- Task Lease
+            locked_by    varchar(100),
+            lease_expires_at timestamp,
+
+            -- Record Timestamps
+            created_at   timestamp default ` + sqliteTimestamp + `,
+            updated_at   timestamp default ` + sqliteTimestamp + `,
+            status_changed_at timestamp default ` + sqliteTimestamp + `
+        );
+
+        CREATE TRIGGER IF NOT EXISTS ` + schema + `set_` + table + `_updated_at_timestamp
+            AFTER UPDATE
+            ON ` + table + `
+            FOR EACH ROW
+        BEGIN
+            UPDATE ` + table + ` SET updated_at = ` + sqliteTimestamp + ` WHERE id = NEW.id;
+        END;`
+}
+
+func sqliteCreateTaskHistoryTable(t string) string {
+	return `
+        CREATE TABLE IF NOT EXISTS ` + sqlHistoryTable(t) + `
+        (
+            -- Primary Key
+            id          integer primary key autoincrement,
+
+            -- Status Transition
+            task_id     integer,
+            from_status varchar(20),
+            to_status   varchar(20),
+            message     varchar(512),
+            actor       varchar(100),
+
+            -- Record Timestamp
+            created_at  timestamp default ` + sqliteTimestamp + `
+        );`
+}
+
+func openSqliteTaskStore(dataUrl string, table string) (*sqlTaskStore, error) {
+	// Accept sqlite://path and sqlite:path (or sqlite3) as well as plain file: DSNs
+	dsn := dataUrl
+	for _, scheme := range []string{"sqlite3://", "sqlite://", "sqlite3:", "sqlite:"} {
+		if strings.HasPrefix(dsn, scheme) {
+			dsn = strings.TrimPrefix(dsn, scheme)
+			break
+		}
+	}
+
+	s, err := openSqlTaskStore(sqliteDriverName, dsn, table)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only allows a single writer, and each connection to :memory: is a
+	// separate database, so share a single connection across the store
+	s.db.SetMaxOpenConns(1)
+
+	err = s.createSqliteTables()
+	if err != nil {
+		_ = s.db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *sqlTaskStore) createSqliteTables() error {
+	_, err := s.db.Exec(sqliteCreateTaskTable(s.table) + sqliteCreateTaskHistoryTable(s.table))
+	return err
+}
+
+// isSqliteDB reports whether db was opened with the sqlite3 driver
+func isSqliteDB(db *sql.DB) bool {
+	_, sqlite := db.Driver().(*sqlite3.SQLiteDriver)
+	return sqlite
+}
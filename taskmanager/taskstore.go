@@ -0,0 +1,212 @@
+package taskmanager
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// TaskStore is the persistence backend used by a TaskManager.  The workflow
+// engine only talks to tasks through this interface, so any backend that
+// implements it can be used in place of the default Postgres store.  Every
+// method but Close should give up when ctx is done and return ctx.Err().
+type TaskStore interface {
+	CreateTask(ctx context.Context, t Task) (Task, error)
+	CountAllTasks(ctx context.Context) (int, error)
+	FindAllTasks(ctx context.Context, options *FindOptions) ([]Task, error)
+
+	// FindTask and DeleteTask return sql.ErrNoRows when no task has the id
+	FindTask(ctx context.Context, id int) (Task, error)
+	DeleteTask(ctx context.Context, id int) error
+
+	// UpdateTask writes a task read at t.Version and increments its version,
+	// returning ErrConcurrentModification if the task has been updated since,
+	// or sql.ErrNoRows if it no longer exists
+	UpdateTask(ctx context.Context, t Task) error
+
+	// TransitionTask updates a task like UpdateTask and records the status
+	// transition h in its history, in a single transaction
+	TransitionTask(ctx context.Context, t Task, h TaskTransition) error
+
+	// ClaimTask atomically locks the first task matching where, by id, that is
+	// not locked or whose lease has expired, and returns it.  The task stays
+	// locked by owner until lease has passed.  It returns sql.ErrNoRows when
+	// no task can be claimed.
+	ClaimTask(ctx context.Context, where *Predicate, owner string, lease time.Duration) (Task, error)
+
+	// RenewLease extends the lock owner holds on a task, returning ErrLeaseLost
+	// when owner no longer holds it
+	RenewLease(ctx context.Context, id int, owner string, lease time.Duration) error
+
+	// ReleaseTask removes the lock owner holds on a task
+	ReleaseTask(ctx context.Context, id int, owner string) error
+
+	// FindTaskHistory returns the transitions of a task in the order they
+	// were recorded
+	FindTaskHistory(ctx context.Context, taskId int) ([]TaskTransition, error)
+
+	Close() error
+}
+
+// openTaskStore selects a TaskStore by the scheme of dataUrl.  Anything that is
+// not a sqlite or memory URL is handed to the Postgres driver as before.
+func openTaskStore(dataUrl string, table string, logger *log.Logger) (TaskStore, error) {
+	if strings.HasPrefix(dataUrl, "memory:") {
+		return NewMemoryTaskStore(), nil
+	}
+
+	var s *sqlTaskStore
+	var err error
+	switch {
+	case strings.HasPrefix(dataUrl, "sqlite:"),
+		strings.HasPrefix(dataUrl, "sqlite3:"),
+		strings.HasPrefix(dataUrl, "file:"):
+		s, err = openSqliteTaskStore(dataUrl, table)
+	default:
+		s, err = openSqlTaskStore("postgres", dataUrl, table)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.logger = logger
+	return s, nil
+}
+
+// Each TaskManager method that reads or writes tasks has a Context variant,
+// e.g. FindTaskContext, that passes ctx on to the TaskStore.  The plain
+// method uses the TaskManager Context.
+
+func (m *TaskManager) CreateTask(t Task) (Task, error) {
+	return m.CreateTaskContext(m.context(), t)
+}
+
+func (m *TaskManager) CreateTaskContext(ctx context.Context, t Task) (Task, error) {
+	if t.Timeout < 1 {
+		t.Timeout = -1
+	}
+	t.Status = "Created"
+
+	// A recurring task with a Schedule first runs at the next scheduled time,
+	// and one with a RecurrenceInterval straight away
+	if t.Recurring {
+		nextRunAt, err := t.nextRunAfter(m.now())
+		if err != nil {
+			return Task{}, err
+		}
+		if t.NextRunAt.IsZero() && t.Schedule != "" {
+			t.NextRunAt = nextRunAt
+		}
+	}
+
+	return m.store.CreateTask(ctx, t)
+}
+
+func (m *TaskManager) CountAllTasks() (int, error) {
+	return m.CountAllTasksContext(m.context())
+}
+
+func (m *TaskManager) CountAllTasksContext(ctx context.Context) (int, error) {
+	return m.store.CountAllTasks(ctx)
+}
+
+func (m *TaskManager) FindAllTasks(options *FindOptions) ([]Task, error) {
+	return m.FindAllTasksContext(m.context(), options)
+}
+
+func (m *TaskManager) FindAllTasksContext(ctx context.Context, options *FindOptions) ([]Task, error) {
+	return m.store.FindAllTasks(ctx, options)
+}
+
+func (m *TaskManager) FindTask(id int) (Task, error) {
+	return m.FindTaskContext(m.context(), id)
+}
+
+func (m *TaskManager) FindTaskContext(ctx context.Context, id int) (Task, error) {
+	task, err := m.store.FindTask(ctx, id)
+	if err != nil {
+		return Task{}, taskNotFound(id, err)
+	}
+	return task, nil
+}
+
+// taskNotFound reports the sql.ErrNoRows a TaskStore returns for a missing
+// task as ErrTaskNotFound
+func taskNotFound(id int, err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return &TaskError{TaskId: id, Err: ErrTaskNotFound}
+	}
+	return err
+}
+
+func (m *TaskManager) FindAllTasksByGroupAndStatus(taskGroup string, status string, options *FindOptions) ([]Task, error) {
+	return m.FindAllTasksByGroupAndStatusContext(m.context(), taskGroup, status, options)
+}
+
+func (m *TaskManager) FindAllTasksByGroupAndStatusContext(ctx context.Context, taskGroup string, status string, options *FindOptions) ([]Task, error) {
+	return m.store.FindAllTasks(ctx, options.where(And(Eq("task_group", taskGroup), Eq("status", status))))
+}
+
+func (m *TaskManager) FindAllTasksByTypeAndStatus(taskType string, status string, options *FindOptions) ([]Task, error) {
+	return m.FindAllTasksByTypeAndStatusContext(m.context(), taskType, status, options)
+}
+
+func (m *TaskManager) FindAllTasksByTypeAndStatusContext(ctx context.Context, taskType string, status string, options *FindOptions) ([]Task, error) {
+	return m.store.FindAllTasks(ctx, options.where(And(Eq("task_type", taskType), Eq("status", status))))
+}
+
+func (m *TaskManager) FindAllRecurringTasks(options *FindOptions) ([]Task, error) {
+	return m.FindAllRecurringTasksContext(m.context(), options)
+}
+
+func (m *TaskManager) FindAllRecurringTasksContext(ctx context.Context, options *FindOptions) ([]Task, error) {
+	return m.store.FindAllTasks(ctx, options.where(Eq("recurring", true)))
+}
+
+func (m *TaskManager) UpdateTask(t Task) error {
+	return m.UpdateTaskContext(m.context(), t)
+}
+
+func (m *TaskManager) UpdateTaskContext(ctx context.Context, t Task) error {
+	if t.Timeout < 1 {
+		t.Timeout = -1
+	}
+
+	return taskNotFound(t.Id, m.store.UpdateTask(ctx, t))
+}
+
+// transitionTask writes a task that has moved from one status to another,
+// along with the record of the transition in its history
+func (m *TaskManager) transitionTask(ctx context.Context, t Task, from string, message string) error {
+	if t.Timeout < 1 {
+		t.Timeout = -1
+	}
+
+	err := m.store.TransitionTask(ctx, t, TaskTransition{
+		TaskId:     t.Id,
+		FromStatus: from,
+		ToStatus:   t.Status,
+		Message:    message,
+		Actor:      m.owner,
+	})
+	return taskNotFound(t.Id, err)
+}
+
+// FindTaskHistory returns every status transition of a task, oldest first
+func (m *TaskManager) FindTaskHistory(id int) ([]TaskTransition, error) {
+	return m.FindTaskHistoryContext(m.context(), id)
+}
+
+func (m *TaskManager) FindTaskHistoryContext(ctx context.Context, id int) ([]TaskTransition, error) {
+	return m.store.FindTaskHistory(ctx, id)
+}
+
+func (m *TaskManager) DeleteTask(id int) error {
+	return m.DeleteTaskContext(m.context(), id)
+}
+
+func (m *TaskManager) DeleteTaskContext(ctx context.Context, id int) error {
+	return taskNotFound(id, m.store.DeleteTask(ctx, id))
+}
@@ -0,0 +1,70 @@
+package taskmanager
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// SweepTimeouts moves every task that has spent longer than its Timeout in its
+// current status to the Timeout status and runs the Timeout handlers of its
+// workflow.  Tasks with a Timeout below 1, or in a status their workflow ends
+// at, never time out.
+func (m *TaskManager) SweepTimeouts() error {
+	return m.SweepTimeoutsContext(m.context())
+}
+
+func (m *TaskManager) SweepTimeoutsContext(ctx context.Context) error {
+	tasks, err := m.store.FindAllTasks(ctx, &FindOptions{Where: Gt("timeout", 0)})
+	if err != nil {
+		return err
+	}
+
+	now := m.now()
+	for _, task := range tasks {
+		// Tasks that have already failed cannot time out
+		if isFailureStatus(task.Status) {
+			continue
+		}
+		if now.Before(task.StatusChangedAt.Add(time.Duration(task.Timeout) * time.Second)) {
+			continue
+		}
+		if !m.ValidTaskType(task.TaskType) {
+			m.println("Warning: cannot time out task " + strconv.Itoa(task.Id) +
+				": invalid task type: " + task.TaskType)
+			continue
+		}
+
+		// Nor can tasks whose workflow has ended
+		w := m.newTaskWorkflow(ctx, task)
+		if w.isTerminal(task.Status) {
+			continue
+		}
+
+		m.handleTaskTimeout(w)
+	}
+
+	return nil
+}
+
+// RunTimeoutSweeper calls SweepTimeoutsContext with ctx every interval until
+// ctx is done or the TaskManager is shut down
+func (m *TaskManager) RunTimeoutSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := m.SweepTimeoutsContext(ctx)
+		if err != nil {
+			m.println("error sweeping task timeouts:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.running.shuttingDown():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package taskmanager
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ValidationError lists every problem found in the workflow definitions
+// passed to New
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid task workflow definitions: " + strings.Join(e.Problems, "; ")
+}
+
+// failureStatuses are entered by the TaskManager itself rather than by
+// Sequence or Transitions
+var failureStatuses = []string{"Error", "Timeout", "DeadLetter"}
+
+// validateWorkflows instantiates every workflow definition and checks its
+// structure, returning a ValidationError with all the problems found
+func validateWorkflows(ctx context.Context, workflows map[string]TaskWorkflowDefinition) error {
+	var taskTypes []string
+	for taskType := range workflows {
+		taskTypes = append(taskTypes, taskType)
+	}
+	sort.Strings(taskTypes)
+
+	var problems []string
+	for _, taskType := range taskTypes {
+		for _, problem := range validateWorkflow(ctx, taskType, workflows[taskType]) {
+			problems = append(problems, "task type '"+taskType+"': "+problem)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func validateWorkflow(ctx context.Context, taskType string, definition TaskWorkflowDefinition) (problems []string) {
+	if definition == nil {
+		return []string{"workflow definition is nil"}
+	}
+
+	// Definitions may read the task from their context, so give them an empty one
+	ctx = context.WithValue(ctx, ContextKey("taskManager"), (*TaskManager)(nil))
+	ctx = context.WithValue(ctx, ContextKey("task"), Task{TaskType: taskType})
+
+	defer func() {
+		r := recover()
+		if r != nil {
+			problems = append(problems, fmt.Sprint("workflow definition panicked: ", r))
+		}
+	}()
+
+	w := definition(ctx)
+	if w == nil {
+		return []string{"workflow definition returned nil"}
+	}
+	return w.validate()
+}
+
+// validate checks the structure of the workflow.  Every status must lead to
+// another, unless the workflow ends there.
+func (w *TaskWorkflow) validate() []string {
+	var problems []string
+
+	if len(w.Sequence) == 0 {
+		problems = append(problems, "Sequence is empty")
+	}
+
+	// Collect every status the task can enter
+	statuses := make(map[string]bool)
+	for _, status := range w.Sequence {
+		if statuses[status] {
+			problems = append(problems, "status '"+status+"' appears more than once in Sequence")
+		}
+		statuses[status] = true
+	}
+	for _, status := range failureStatuses {
+		statuses[status] = true
+	}
+	for _, from := range sortedKeys(w.Transitions) {
+		for _, to := range w.Transitions[from] {
+			statuses[to] = true
+		}
+	}
+
+	for _, from := range sortedKeys(w.Transitions) {
+		if !statuses[from] {
+			problems = append(problems, "Transitions declared for unknown status '"+from+"'")
+		}
+	}
+
+	// Every status the task can run in needs handlers, and somewhere to go next
+	for _, status := range sortedKeys(statuses) {
+		if isFailureStatus(status) {
+			continue
+		}
+		handlers := w.Handlers[status]
+		if len(handlers) == 0 {
+			problems = append(problems, "status '"+status+"' has no Handlers")
+		}
+		for i := range handlers {
+			if handlers[i] == nil {
+				problems = append(problems, fmt.Sprintf("handler %d for status '%s' is nil", i, status))
+			}
+		}
+		if !w.isTerminal(status) && len(w.nextStatuses(status)) == 0 {
+			problems = append(problems, "status '"+status+"' has no next status, and needs Transitions "+
+				"(an empty entry if the workflow ends there)")
+		}
+	}
+
+	for _, status := range sortedKeys(w.Handlers) {
+		if !statuses[status] {
+			problems = append(problems, "Handlers declared for unknown status '"+status+"'")
+		}
+	}
+	for _, status := range sortedKeys(w.Timeouts) {
+		if !statuses[status] {
+			problems = append(problems, "Timeouts declared for unknown status '"+status+"'")
+		}
+	}
+	for _, status := range sortedKeys(w.Retries) {
+		if !statuses[status] {
+			problems = append(problems, "Retries declared for unknown status '"+status+"'")
+		}
+	}
+	for _, status := range w.Waits {
+		if !statuses[status] || isFailureStatus(status) {
+			problems = append(problems, "Waits declared for unknown status '"+status+"'")
+		}
+	}
+
+	return problems
+}
+
+func isFailureStatus(status string) bool {
+	for _, s := range failureStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedKeys returns the keys of a map with string keys in order, so that
+// problems are always reported in the same order
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
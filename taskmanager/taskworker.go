@@ -0,0 +1,121 @@
+package taskmanager
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Worker claims Created tasks from its TaskManager and runs them, so that
+// tasks no longer need to be started by hand with StartTask.  Any number of
+// workers, in any number of processes, may share the same task table.
+// Recurring tasks are left to the scheduler.
+//
+// A worker also reclaims tasks whose lease has expired, because the process
+// running them died or stopped sending heartbeats, and resumes them from the
+// handlers of their current status.
+type Worker struct {
+	// Only claim tasks with this TaskGroup and TaskType when they are set
+	TaskGroup string
+	TaskType  string
+
+	// The maximum number of tasks run at the same time
+	Concurrency int
+
+	// How long to wait before polling again when there are no tasks to claim
+	PollInterval time.Duration
+
+	manager *TaskManager
+}
+
+func (m *TaskManager) NewWorker(concurrency int) *Worker {
+	return &Worker{
+		Concurrency:  concurrency,
+		PollInterval: time.Second,
+		manager:      m,
+	}
+}
+
+// Run claims and runs tasks until ctx is done or the TaskManager is shut
+// down, then waits for the tasks already running to finish
+func (w *Worker) Run(ctx context.Context) {
+	concurrency := w.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+
+	var running sync.WaitGroup
+	defer running.Wait()
+
+	for {
+		// Wait for a free slot before claiming a task
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.manager.running.shuttingDown():
+			return
+		case slots <- struct{}{}:
+		}
+
+		task, err := w.manager.store.ClaimTask(ctx, w.claimPredicate(), w.manager.owner, w.manager.leaseDuration())
+		if err != nil {
+			<-slots
+			if !errors.Is(err, sql.ErrNoRows) && ctx.Err() == nil {
+				w.manager.println("error claiming task:", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-w.manager.running.shuttingDown():
+				return
+			case <-time.After(w.PollInterval):
+			}
+			continue
+		}
+
+		running.Add(1)
+		go func(task Task) {
+			defer running.Done()
+			defer func() { <-slots }()
+
+			// Tasks run with the TaskManager Context, so that they can finish
+			// after ctx is done
+			err := w.manager.resumeTask(w.manager.context(), task)
+			if err != nil {
+				w.manager.println("error running task "+strconv.Itoa(task.Id)+":", err)
+			}
+		}(task)
+	}
+}
+
+func (w *Worker) claimPredicate() *Predicate {
+	where := []*Predicate{
+		Or(
+			And(Eq("status", "Created"), Eq("recurring", false)),
+			Lt("lease_expires_at", time.Now()),
+		),
+	}
+	if w.TaskGroup != "" {
+		where = append(where, Eq("task_group", w.TaskGroup))
+	}
+
+	// Never claim a task the TaskManager has no workflow for
+	var taskTypes []*Predicate
+	for taskType := range w.manager.workflows {
+		if w.TaskType == "" || w.TaskType == taskType {
+			taskTypes = append(taskTypes, Eq("task_type", taskType))
+		}
+	}
+	if len(taskTypes) == 0 {
+		// Task ids start at 1, so this matches nothing
+		taskTypes = append(taskTypes, Eq("id", 0))
+	}
+	where = append(where, Or(taskTypes...))
+
+	return And(where...)
+}
@@ -3,7 +3,6 @@ package taskmanager
 import (
 	"context"
 	"encoding/json"
-	"log"
 )
 
 type TaskWorkflow struct {
@@ -11,6 +10,21 @@ type TaskWorkflow struct {
 	Sequence []string                         `json:"sequence"`
 	Timeouts map[string]int                   `json:"timeouts"`
 	Handlers map[string][]TaskWorkflowHandler `json:"handlers"`
+
+	// Transitions are optional, and list the statuses a handler may choose
+	// with GoTo.  A status without declared transitions moves to the next
+	// status in Sequence.  An empty entry ends the workflow at that status, as
+	// the last status in Sequence does when it declares none, without its
+	// handlers needing to return End.
+	Transitions map[string][]string `json:"transitions"`
+
+	// Waits are optional, and list the statuses whose handlers wait for
+	// NotifyTaskWaitStatusResult to move the task on
+	Waits []string `json:"waits"`
+
+	// Retries are optional, and a status without a RetryPolicy fails on the
+	// first handler error
+	Retries map[string]RetryPolicy `json:"retries"`
 }
 
 type ContextKey string
@@ -46,8 +60,9 @@ func DefaultTaskWorkflow(ctx context.Context) *TaskWorkflow {
 			"Created", "Active", "Waiting", "Complete",
 		},
 		Timeouts: map[string]int{
-			"Created": -1, "Active": 300, "Waiting": -1, "Complete": -1, "Error": -1, "Timeout": -1,
+			"Created": -1, "Active": 300, "Waiting": -1, "Complete": -1, "Error": -1, "Timeout": -1, "DeadLetter": -1,
 		},
+		Waits: []string{"Waiting"},
 		Handlers: map[string][]TaskWorkflowHandler{
 			"Created": {
 				defaultCreateLogMessage,
@@ -68,46 +83,106 @@ func DefaultTaskWorkflow(ctx context.Context) *TaskWorkflow {
 			"Error": {
 				defaultErrorLogMessage,
 			},
+			"Timeout": {
+				defaultTimeoutLogMessage,
+			},
+			"DeadLetter": {
+				defaultDeadLetterLogMessage,
+			},
 		},
 	}
 }
 
-func NextStatus(w *TaskWorkflow) error {
-	// NoOp Function to tell the workflow to increment task state in sequence
+// canTransition reports whether the workflow allows a task to move from one
+// status to another
+func (w *TaskWorkflow) canTransition(from string, to string) bool {
+	for _, next := range w.nextStatuses(from) {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// nextStatuses returns the declared Transitions of a status, or else the next
+// status in Sequence
+func (w *TaskWorkflow) nextStatuses(status string) []string {
+	if next, declared := w.Transitions[status]; declared {
+		return next
+	}
+
+	for i := 0; i < len(w.Sequence)-1; i++ {
+		if w.Sequence[i] == status {
+			return []string{w.Sequence[i+1]}
+		}
+	}
 	return nil
 }
 
+// isWait reports whether status waits for NotifyTaskWaitStatusResult
+func (w *TaskWorkflow) isWait(status string) bool {
+	for i := range w.Waits {
+		if w.Waits[i] == status {
+			return true
+		}
+	}
+	return false
+}
+
+// isTerminal reports whether the workflow ends at status
+func (w *TaskWorkflow) isTerminal(status string) bool {
+	if next, declared := w.Transitions[status]; declared {
+		return len(next) == 0
+	}
+	return len(w.Sequence) > 0 && w.Sequence[len(w.Sequence)-1] == status
+}
+
+func NextStatus(w *TaskWorkflow) error {
+	// Tell the workflow to increment task state in sequence
+	return Advance
+}
+
 func EndWorkflow(w *TaskWorkflow) error {
-	// NoOp Function to tell the workflow to end processing
-	return nil
+	// Tell the workflow to end processing
+	return End
 }
 
 func WaitForNotify(w *TaskWorkflow) error {
-	// NoOp Function to tell the workflow to do nothing and wait to resume or end
-	return nil
+	// Tell the workflow to do nothing and wait to resume or end
+	return Wait
 }
 
 func defaultCreateLogMessage(w *TaskWorkflow) error {
-	log.Println("Task Created: task", w.GetTask().Id, "has been created")
+	w.GetTaskManager().println("Task Created: task", w.GetTask().Id, "has been created")
 	return nil
 }
 
 func defaultActiveLogMessage(w *TaskWorkflow) error {
-	log.Println("Task Active: task", w.GetTask().Id, "is active")
+	w.GetTaskManager().println("Task Active: task", w.GetTask().Id, "is active")
 	return nil
 }
 
 func defaultWaitingLogMessage(w *TaskWorkflow) error {
-	log.Println("Task Waiting: task", w.GetTask().Id, "is waiting")
+	w.GetTaskManager().println("Task Waiting: task", w.GetTask().Id, "is waiting")
 	return nil
 }
 
 func defaultCompleteLogMessage(w *TaskWorkflow) error {
-	log.Println("Task Complete: task", w.GetTask().Id, "is complete")
+	w.GetTaskManager().println("Task Complete: task", w.GetTask().Id, "is complete")
 	return nil
 }
 
 func defaultErrorLogMessage(w *TaskWorkflow) error {
-	log.Println("Task Error: task", w.GetTask().Id, "has an error")
+	w.GetTaskManager().println("Task Error: task", w.GetTask().Id, "has an error")
+	return nil
+}
+
+func defaultTimeoutLogMessage(w *TaskWorkflow) error {
+	w.GetTaskManager().println("Task Timeout: task", w.GetTask().Id, "has timed out")
+	return nil
+}
+
+func defaultDeadLetterLogMessage(w *TaskWorkflow) error {
+	w.GetTaskManager().println("Task DeadLetter: task", w.GetTask().Id, "has exhausted its retries")
 	return nil
 }
@@ -3,6 +3,9 @@ create table task_manager
     -- Primary Key
     id           serial not null,
 
+    -- Record Version
+    version      integer default 1,
+
     -- Task Reference Id
     reference_id varchar(20),
 
@@ -15,9 +18,39 @@ create table task_manager
     message      varchar(512),
     properties   bytea,
 
+    -- Recurring Task Schedule
+    schedule     varchar(100),
+    recurrence_interval integer,
+    next_run_at  timestamptz,
+
+    -- Task Retries
+    attempt      integer default 0,
+    failures     text,
+
+    -- Task Lease
+    locked_by    varchar(100),
+    lease_expires_at timestamptz,
+
     -- Record Timestamps
     created_at   timestamptz default now(),
-    updated_at   timestamptz default now()
+    updated_at   timestamptz default now(),
+    status_changed_at timestamptz default now()
+);
+
+create table task_manager_history
+(
+    -- Primary Key
+    id          serial not null,
+
+    -- Status Transition
+    task_id     integer,
+    from_status varchar(20),
+    to_status   varchar(20),
+    message     varchar(512),
+    actor       varchar(100),
+
+    -- Record Timestamp
+    created_at  timestamptz default now()
 );
 
 create or replace function get_updated_at_timestamp() returns trigger
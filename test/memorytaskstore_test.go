@@ -0,0 +1,419 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tnyidea/taskmanager-go/taskmanager"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newMemoryTaskManager(t *testing.T, opts ...taskmanager.Option) *taskmanager.TaskManager {
+	m, err := taskmanager.New(append([]taskmanager.Option{
+		taskmanager.WithStore(taskmanager.NewMemoryTaskStore()),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType": taskmanager.DefaultTaskWorkflow,
+		}),
+	}, opts...)...)
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	return m
+}
+
+func TestMemoryStartTaskAndNotify(t *testing.T) {
+	m := newMemoryTaskManager(t)
+	err := m.Open()
+	if err != nil {
+		log.Println(err)
+		t.FailNow()
+	}
+	defer m.Close()
+
+	task, err := m.CreateTask(testTask)
+	if err != nil {
+		log.Println("taskmanager.CreateTask:", err)
+		t.FailNow()
+	}
+	id := task.Id
+
+	err = m.StartTask(id)
+	if err != nil {
+		log.Println("taskmanager.StartTask:", err)
+		t.FailNow()
+	}
+
+	task, err = m.FindTask(id)
+	if err != nil {
+		log.Println("taskmanager.FindTask:", err)
+		t.FailNow()
+	}
+	if task.Status != "Waiting" {
+		log.Println("expected task status 'Waiting' after StartTask(): result received:", task.Status)
+		t.FailNow()
+	}
+
+	err = m.NotifyTaskWaitStatusResult(id, "success", "")
+	if err != nil {
+		log.Println("taskmanager.NotifyTaskWaitStatusResult:", err)
+		t.FailNow()
+	}
+
+	task, err = m.FindTask(id)
+	if err != nil {
+		log.Println("taskmanager.FindTask:", err)
+		t.FailNow()
+	}
+	if task.Status != "Complete" {
+		log.Println("expected task status 'Complete' after NotifyTaskWaitStatusResult(): result received:", task.Status)
+		t.FailNow()
+	}
+}
+
+func TestMemoryFindAllTasks(t *testing.T) {
+	m := newMemoryTaskManager(t)
+	err := m.Open()
+	if err != nil {
+		log.Println(err)
+		t.FailNow()
+	}
+	defer m.Close()
+
+	for _, referenceId := range []string{"alpha", "beta", "gamma", "Alphabet"} {
+		task := testTask
+		task.ReferenceId = referenceId
+		_, err := m.CreateTask(task)
+		if err != nil {
+			log.Println("taskmanager.CreateTask:", err)
+			t.FailNow()
+		}
+	}
+
+	count, err := m.CountAllTasks()
+	if err != nil || count != 4 {
+		log.Println("expected CountAllTasks to be 4: result received:", count, err)
+		t.FailNow()
+	}
+
+	tasks, err := m.FindAllTasksByGroupAndStatus("TaskGroup", "Created", &taskmanager.FindOptions{
+		Filters:    []taskmanager.FindFilter{{Column: "reference_id", Value: "alp"}},
+		SortColumn: "reference_id",
+		SortOrder:  "DESC",
+	})
+	if err != nil {
+		log.Println("taskmanager.FindAllTasksByGroupAndStatus:", err)
+		t.FailNow()
+	}
+	if len(tasks) != 2 || tasks[0].ReferenceId != "alpha" || tasks[1].ReferenceId != "Alphabet" {
+		log.Println("unexpected FindAllTasksByGroupAndStatus result:", tasks)
+		t.FailNow()
+	}
+
+	tasks, err = m.FindAllTasksByTypeAndStatus("TaskType", "Created", &taskmanager.FindOptions{
+		Where: taskmanager.Or(
+			taskmanager.Eq("reference_id", "beta"),
+			taskmanager.And(taskmanager.Prefix("reference_id", "g"), taskmanager.Ge("id", 3)),
+		),
+		SortColumn: "id",
+	})
+	if err != nil {
+		log.Println("taskmanager.FindAllTasksByTypeAndStatus:", err)
+		t.FailNow()
+	}
+	if len(tasks) != 2 || tasks[0].ReferenceId != "beta" || tasks[1].ReferenceId != "gamma" {
+		log.Println("unexpected FindAllTasksByTypeAndStatus result:", tasks)
+		t.FailNow()
+	}
+
+	options, err := taskmanager.ParseFindOptions(map[string]string{
+		"rangeStart": "1",
+		"rangeEnd":   "3",
+	})
+	if err != nil {
+		log.Println("taskmanager.ParseFindOptions:", err)
+		t.FailNow()
+	}
+
+	tasks, err = m.FindAllTasks(options)
+	if err != nil {
+		log.Println("taskmanager.FindAllTasks:", err)
+		t.FailNow()
+	}
+	if len(tasks) != 2 || tasks[0].Id != 2 || tasks[1].Id != 3 {
+		log.Println("unexpected FindAllTasks range result:", tasks)
+		t.FailNow()
+	}
+
+	err = m.DeleteTask(1)
+	if err != nil {
+		log.Println("taskmanager.DeleteTask:", err)
+		t.FailNow()
+	}
+	_, err = m.FindTask(1)
+	if !errors.Is(err, taskmanager.ErrTaskNotFound) {
+		log.Println("expected ErrTaskNotFound after DeleteTask: result received:", err)
+		t.FailNow()
+	}
+
+	// A deleted task is missing rather than concurrently modified
+	var taskErr *taskmanager.TaskError
+	err = m.DeleteTask(1)
+	if !errors.Is(err, taskmanager.ErrTaskNotFound) || !errors.As(err, &taskErr) || taskErr.TaskId != 1 {
+		log.Println("expected ErrTaskNotFound deleting a deleted task: result received:", err)
+		t.FailNow()
+	}
+	err = m.UpdateTask(taskmanager.Task{Id: 1, Version: 1})
+	if !errors.Is(err, taskmanager.ErrTaskNotFound) || errors.Is(err, taskmanager.ErrConcurrentModification) {
+		log.Println("expected ErrTaskNotFound updating a deleted task: result received:", err)
+		t.FailNow()
+	}
+}
+
+func TestInvalidFindOptions(t *testing.T) {
+	_, err := taskmanager.ParseFindOptions(map[string]string{
+		"rangeStart": "zero",
+		"rangeEnd":   "10",
+	})
+	if err == nil {
+		log.Println("expected ParseFindOptions to reject an unparseable rangeStart")
+		t.FailNow()
+	}
+
+	m := newMemoryTaskManager(t)
+	_ = m.Open()
+	defer m.Close()
+
+	_, err = m.FindAllTasks(&taskmanager.FindOptions{
+		Filters: []taskmanager.FindFilter{{Column: "status = status; --", Value: "x"}},
+	})
+	if err == nil {
+		log.Println("expected FindAllTasks to reject a filter column that is not a task column")
+		t.FailNow()
+	}
+}
+
+// renderPredicate translates a predicate the way a TaskStore outside the
+// taskmanager package would
+func renderPredicate(p *taskmanager.Predicate) string {
+	switch p.Op() {
+	case "AND", "OR":
+		var operands []string
+		for _, operand := range p.Operands() {
+			operands = append(operands, renderPredicate(operand))
+		}
+		return "(" + strings.Join(operands, " "+p.Op()+" ") + ")"
+	case "null":
+		return p.Column() + " is null"
+	default:
+		return fmt.Sprint(p.Column(), " ", p.Op(), " ", p.Value())
+	}
+}
+
+func TestPredicateInspection(t *testing.T) {
+	options := &taskmanager.FindOptions{
+		Where: taskmanager.Or(
+			taskmanager.Eq("reference_id", "beta"),
+			taskmanager.And(taskmanager.Ge("id", 3), taskmanager.IsNull("locked_by")),
+		),
+		Filters: []taskmanager.FindFilter{{Column: "task_group", Value: "Task"}},
+	}
+
+	want := "((reference_id = beta OR (id >= 3 AND locked_by is null)) AND task_group prefix Task)"
+	got := renderPredicate(options.Predicate())
+	if got != want {
+		log.Println("unexpected predicate rendering: result received:", got)
+		t.FailNow()
+	}
+
+	task := testTask
+	task.Id = 4
+	if !options.Predicate().Match(task) {
+		log.Println("expected the predicate to match task 4")
+		t.FailNow()
+	}
+	task.Id = 2
+	if options.Predicate().Match(task) {
+		log.Println("expected the predicate not to match task 2")
+		t.FailNow()
+	}
+	if !(*taskmanager.FindOptions)(nil).Predicate().Match(task) {
+		log.Println("expected nil FindOptions to match every task")
+		t.FailNow()
+	}
+}
+
+func TestMemoryTaskErrors(t *testing.T) {
+	m := newMemoryTaskManager(t)
+	_ = m.Open()
+	defer m.Close()
+
+	var taskErr *taskmanager.TaskError
+	err := m.StartTask(42)
+	if !errors.Is(err, taskmanager.ErrTaskNotFound) || !errors.As(err, &taskErr) || taskErr.TaskId != 42 {
+		log.Println("expected ErrTaskNotFound for task ID 42: result received:", err)
+		t.FailNow()
+	}
+
+	invalid := testTask
+	invalid.TaskType = "UnknownType"
+	task, _ := m.CreateTask(invalid)
+	err = m.NotifyTaskWaitStatusResult(task.Id, "success", "")
+	if !errors.Is(err, taskmanager.ErrInvalidTaskType) {
+		log.Println("expected ErrInvalidTaskType: result received:", err)
+		t.FailNow()
+	}
+
+	task, _ = m.CreateTask(testTask)
+	_ = m.StartTask(task.Id)
+	err = m.StartTask(task.Id)
+	if !errors.Is(err, taskmanager.ErrInvalidState) || !errors.As(err, &taskErr) || taskErr.Status != "Waiting" {
+		log.Println("expected ErrInvalidState for a 'Waiting' task: result received:", err)
+		t.FailNow()
+	}
+
+	// A repeated start leaves a recurring task alone rather than failing it and
+	// starting the next run of its series
+	recurring := testTask
+	recurring.Recurring = true
+	recurring.RecurrenceInterval = 60
+	recurring.NextRunAt = time.Now().Add(-time.Minute)
+	recurring, _ = m.CreateTask(recurring)
+	_ = m.StartTask(recurring.Id)
+	err = m.StartTask(recurring.Id)
+	recurring, _ = m.FindTask(recurring.Id)
+	if !errors.Is(err, taskmanager.ErrInvalidState) || recurring.Status != "Waiting" {
+		log.Println("expected ErrInvalidState leaving the recurring task 'Waiting': result received:", err, &recurring)
+		t.FailNow()
+	}
+	created, _ := m.FindAllRecurringTasks(&taskmanager.FindOptions{Where: taskmanager.Eq("status", "Created")})
+	if len(created) != 0 {
+		log.Println("expected no next run of the recurring series: result received:", created)
+		t.FailNow()
+	}
+
+	// An unknown result is rejected before the task is claimed
+	task, _ = m.CreateTask(testTask)
+	_ = m.StartTask(task.Id)
+	err = m.NotifyTaskWaitStatusResult(task.Id, "approved", "")
+	task, _ = m.FindTask(task.Id)
+	if err == nil || task.Status != "Waiting" || task.LockedBy != "" {
+		log.Println("expected an unknown result to leave the task waiting and unclaimed: result received:", err, &task)
+		t.FailNow()
+	}
+
+	// A duplicate notification cannot move on a task that is no longer waiting
+	_ = m.NotifyTaskWaitStatusResult(task.Id, "success", "")
+	err = m.NotifyTaskWaitStatusResult(task.Id, "success", "")
+	task, _ = m.FindTask(task.Id)
+	if !errors.Is(err, taskmanager.ErrInvalidState) || !errors.As(err, &taskErr) || task.Status != "Complete" {
+		log.Println("expected ErrInvalidState for a duplicate notification: result received:", err, &task)
+		t.FailNow()
+	}
+}
+
+type contextTestKey string
+
+func TestMemoryTaskContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextTestKey("caller"), "StartTaskContext"))
+	defer cancel()
+
+	var caller interface{}
+	m, err := taskmanager.New(taskmanager.WithStore(taskmanager.NewMemoryTaskStore()),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType": func(ctx context.Context) *taskmanager.TaskWorkflow {
+				w := taskmanager.DefaultTaskWorkflow(ctx)
+				w.Handlers["Created"] = []taskmanager.TaskWorkflowHandler{
+					func(w *taskmanager.TaskWorkflow) error {
+						caller = w.Context.Value(contextTestKey("caller"))
+						cancel()
+						return w.Context.Err()
+					},
+				}
+				return w
+			},
+		}))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	_ = m.Open()
+	defer m.Close()
+
+	task, _ := m.CreateTask(testTask)
+	err = m.StartTaskContext(ctx, task.Id)
+	if caller != "StartTaskContext" {
+		log.Println("expected handler to see the values of the context passed to StartTaskContext: result received:", caller)
+		t.FailNow()
+	}
+	if !errors.Is(err, context.Canceled) {
+		log.Println("expected context.Canceled from StartTaskContext: result received:", err)
+		t.FailNow()
+	}
+
+	// The task is left for a worker to resume rather than failed
+	task, _ = m.FindTask(task.Id)
+	if task.Status != "Created" || task.LockedBy == "" || task.LeaseExpiresAt.After(time.Now()) {
+		log.Println("expected a 'Created' task with an expired lease: result received:",
+			task.Status, task.LockedBy, task.LeaseExpiresAt)
+		t.FailNow()
+	}
+
+	_, err = m.FindTaskContext(ctx, task.Id)
+	if !errors.Is(err, context.Canceled) {
+		log.Println("expected context.Canceled from FindTaskContext: result received:", err)
+		t.FailNow()
+	}
+}
+
+func TestRunSchedulerContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextTestKey("caller"), "RunScheduler"))
+	defer cancel()
+
+	var caller interface{}
+	now := time.Now()
+	m, err := taskmanager.New(taskmanager.WithStore(taskmanager.NewMemoryTaskStore()),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType": func(ctx context.Context) *taskmanager.TaskWorkflow {
+				w := taskmanager.DefaultTaskWorkflow(ctx)
+				w.Handlers["Created"] = []taskmanager.TaskWorkflowHandler{
+					func(w *taskmanager.TaskWorkflow) error {
+						caller = w.Context.Value(contextTestKey("caller"))
+						cancel()
+						return taskmanager.End
+					},
+				}
+				return w
+			},
+		}),
+		taskmanager.WithClock(func() time.Time { return now }))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	_ = m.Open()
+	defer m.Close()
+
+	recurring := testTask
+	recurring.Recurring = true
+	recurring.RecurrenceInterval = 60
+	_, _ = m.CreateTask(recurring)
+
+	// RunScheduler returns once the handler has cancelled ctx
+	now = now.Add(time.Hour)
+	m.RunScheduler(ctx, time.Hour)
+	if caller != "RunScheduler" {
+		log.Println("expected handler to see the values of the context passed to RunScheduler: result received:", caller)
+		t.FailNow()
+	}
+
+	// The run ended after ctx was cancelled, and its series still goes on
+	count, _ := m.CountAllTasks()
+	if count != 2 {
+		log.Println("expected the next run of the recurring series: result received:", count)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,124 @@
+package test
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"github.com/tnyidea/taskmanager-go/taskmanager"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvalidOptions(t *testing.T) {
+	store := taskmanager.NewMemoryTaskStore()
+	invalid := map[string][]taskmanager.Option{
+		"no store":           {},
+		"two stores":         {taskmanager.WithDataURL(TaskManagerSqliteTestDataUrl), taskmanager.WithStore(store)},
+		"empty data URL":     {taskmanager.WithDataURL("")},
+		"nil database":       {taskmanager.WithDB(nil)},
+		"nil store":          {taskmanager.WithStore(nil)},
+		"nil workflows":      {taskmanager.WithStore(store), taskmanager.WithWorkflows(nil)},
+		"invalid table name": {taskmanager.WithStore(store), taskmanager.WithTable("tasks; DROP TABLE tasks")},
+		"nil logger":         {taskmanager.WithStore(store), taskmanager.WithLogger(nil)},
+		"nil clock":          {taskmanager.WithStore(store), taskmanager.WithClock(nil)},
+		"unknown catch up":   {taskmanager.WithStore(store), taskmanager.WithCatchUp(taskmanager.CatchUpPolicy(42))},
+		"zero lease":         {taskmanager.WithStore(store), taskmanager.WithLeaseDuration(0)},
+	}
+	for name, opts := range invalid {
+		_, err := taskmanager.New(opts...)
+		if !errors.Is(err, taskmanager.ErrInvalidOption) {
+			log.Println("expected ErrInvalidOption for "+name+": result received:", err)
+			t.FailNow()
+		}
+	}
+
+	// A TaskManager without workflows can still manage task data
+	m, err := taskmanager.New(taskmanager.WithStore(store))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	if m.ValidTaskType("TaskType") {
+		log.Println("expected no valid task types without WithWorkflows")
+		t.FailNow()
+	}
+}
+
+func TestNewWithDB(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		log.Println("sql.Open:", err)
+		t.FailNow()
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+
+	var logged bytes.Buffer
+	now := time.Date(2030, 1, 1, 10, 30, 0, 0, time.UTC)
+	m, err := taskmanager.New(
+		taskmanager.WithDB(db),
+		taskmanager.WithTable("custom_tasks"),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType": taskmanager.DefaultTaskWorkflow,
+		}),
+		taskmanager.WithLogger(log.New(&logged, "", 0)),
+		taskmanager.WithClock(func() time.Time { return now }),
+	)
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	err = m.Open()
+	if err != nil {
+		log.Println(err)
+		t.FailNow()
+	}
+
+	// Recurring tasks are scheduled by the clock given with WithClock
+	recurring := testTask
+	recurring.Recurring = true
+	recurring.Schedule = "@hourly"
+	recurring, err = m.CreateTask(recurring)
+	if err != nil {
+		log.Println("taskmanager.CreateTask:", err)
+		t.FailNow()
+	}
+	if !recurring.NextRunAt.Equal(time.Date(2030, 1, 1, 11, 0, 0, 0, time.UTC)) {
+		log.Println("expected the next run to be scheduled from the clock: result received:", recurring.NextRunAt)
+		t.FailNow()
+	}
+
+	task, _ := m.CreateTask(testTask)
+	err = m.StartTask(task.Id)
+	if err != nil {
+		log.Println("taskmanager.StartTask:", err)
+		t.FailNow()
+	}
+	if !strings.Contains(logged.String(), "Task Created: task") {
+		log.Println("expected workflow handlers to log to the logger given with WithLogger: result received:", logged.String())
+		t.FailNow()
+	}
+
+	// The store logs to the logger given with WithLogger as well
+	_, err = db.Exec("UPDATE custom_tasks SET failures = 'not json' WHERE id = ?", task.Id)
+	if err != nil {
+		log.Println("db.Exec:", err)
+		t.FailNow()
+	}
+	_, _ = m.FindTask(task.Id)
+	if !strings.Contains(logged.String(), "Warning: could not read task failures") {
+		log.Println("expected the store to log to the logger given with WithLogger: result received:", logged.String())
+		t.FailNow()
+	}
+
+	// The database belongs to the caller, so it is still open after Close
+	m.Close()
+	var count int
+	err = db.QueryRow("SELECT count(*) FROM custom_tasks").Scan(&count)
+	if err != nil || count != 2 {
+		log.Println("expected 2 tasks in custom_tasks after Close: result received:", count, err)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,440 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"github.com/tnyidea/taskmanager-go/taskmanager"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const TaskManagerSqliteTestDataUrl = "sqlite::memory:"
+
+func TestSqliteStartTaskAndNotify(t *testing.T) {
+	m, err := taskmanager.New(taskmanager.WithDataURL(TaskManagerSqliteTestDataUrl),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType": taskmanager.DefaultTaskWorkflow,
+		}))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	err = m.Open()
+	if err != nil {
+		log.Println(err)
+		t.FailNow()
+	}
+	defer m.Close()
+
+	task, err := m.CreateTask(testTask)
+	if err != nil {
+		log.Println("taskmanager.CreateTask:", err)
+		t.FailNow()
+	}
+	id := task.Id
+
+	err = m.StartTask(id)
+	if err != nil {
+		log.Println("taskmanager.StartTask:", err)
+		t.FailNow()
+	}
+
+	err = m.NotifyTaskWaitStatusResult(id, "success", "")
+	if err != nil {
+		log.Println("taskmanager.NotifyTaskWaitStatusResult:", err)
+		t.FailNow()
+	}
+
+	task, err = m.FindTask(id)
+	if err != nil {
+		log.Println("taskmanager.FindTask:", err)
+		t.FailNow()
+	}
+	if task.Status != "Complete" {
+		log.Println("expected task status 'Complete' after NotifyTaskWaitStatusResult(): result received:", task.Status)
+		t.FailNow()
+	}
+	if task.CreatedAt.IsZero() || task.UpdatedAt.Before(task.CreatedAt) {
+		log.Println("expected record timestamps to be maintained by the database:", task.CreatedAt, task.UpdatedAt)
+		t.FailNow()
+	}
+
+	tasks, err := m.FindAllTasksByTypeAndStatus("TaskType", "Complete", &taskmanager.FindOptions{
+		SortColumn: "id",
+		SortOrder:  "DESC",
+		Limit:      10,
+	})
+	if err != nil {
+		log.Println("taskmanager.FindAllTasksByTypeAndStatus:", err)
+		t.FailNow()
+	}
+	if len(tasks) != 1 || tasks[0].Id != id {
+		log.Println("unexpected FindAllTasksByTypeAndStatus result:", tasks)
+		t.FailNow()
+	}
+
+	tasks, err = m.FindAllTasksByGroupAndStatus("TaskGroup", "Complete", &taskmanager.FindOptions{
+		Where: taskmanager.Or(
+			taskmanager.Eq("recurring", true),
+			taskmanager.Prefix("reference_id", "reference"),
+		),
+		Filters: []taskmanager.FindFilter{{Column: "task_type", Value: "task"}},
+	})
+	if err != nil {
+		log.Println("taskmanager.FindAllTasksByGroupAndStatus:", err)
+		t.FailNow()
+	}
+	if len(tasks) != 1 || tasks[0].Id != id {
+		log.Println("unexpected FindAllTasksByGroupAndStatus result:", tasks)
+		t.FailNow()
+	}
+
+	tasks, err = m.FindAllTasks(&taskmanager.FindOptions{
+		Where: taskmanager.And(
+			taskmanager.Ge("created_at", task.CreatedAt),
+			taskmanager.Lt("created_at", task.CreatedAt.Add(time.Minute)),
+		),
+		SortColumn: "updated_at",
+	})
+	if err != nil {
+		log.Println("taskmanager.FindAllTasks:", err)
+		t.FailNow()
+	}
+	if len(tasks) != 1 || tasks[0].Id != id {
+		log.Println("unexpected FindAllTasks created_at range result:", tasks)
+		t.FailNow()
+	}
+
+	tasks, err = m.FindAllTasks(&taskmanager.FindOptions{
+		Filters: []taskmanager.FindFilter{{Column: "reference_id", Value: "reference"}},
+		Offset:  1,
+	})
+	if err != nil {
+		log.Println("taskmanager.FindAllTasks:", err)
+		t.FailNow()
+	}
+	if len(tasks) != 0 {
+		log.Println("unexpected FindAllTasks result with offset past the only task:", tasks)
+		t.FailNow()
+	}
+}
+
+func TestSqliteDeadLetter(t *testing.T) {
+	m, err := taskmanager.New(taskmanager.WithDataURL(TaskManagerSqliteTestDataUrl),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType": failingTaskWorkflow,
+		}))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	err = m.Open()
+	if err != nil {
+		log.Println(err)
+		t.FailNow()
+	}
+	defer m.Close()
+
+	task, _ := m.CreateTask(testTask)
+	err = m.StartTask(task.Id)
+	if err != nil {
+		log.Println("taskmanager.StartTask:", err)
+		t.FailNow()
+	}
+	runWorkerUntilStatus(t, m, task.Id, "DeadLetter")
+
+	tasks, err := m.FindDeadLetterTasks(nil)
+	if err != nil {
+		log.Println("taskmanager.FindDeadLetterTasks:", err)
+		t.FailNow()
+	}
+	if len(tasks) != 1 || tasks[0].Id != task.Id {
+		log.Println("expected 1 dead letter task: result received:", tasks)
+		t.FailNow()
+	}
+	task = tasks[0]
+	if len(task.Failures) != 2 || task.Failures[1].Attempt != 2 || task.Failures[1].Message != "failing handler" {
+		log.Println("expected the error history of both attempts: result received:", task.Failures)
+		t.FailNow()
+	}
+
+	// Only DeadLetter tasks can be requeued
+	err = m.RequeueDeadLetterTask(task.Id)
+	if err != nil {
+		log.Println("taskmanager.RequeueDeadLetterTask:", err)
+		t.FailNow()
+	}
+	err = m.RequeueDeadLetterTask(task.Id)
+	if err == nil {
+		log.Println("expected RequeueDeadLetterTask to fail for a 'Created' task")
+		t.FailNow()
+	}
+
+	task, _ = m.FindTask(task.Id)
+	if task.Status != "Created" || task.Attempt != 0 || len(task.Failures) != 2 {
+		log.Println("expected requeued task to be 'Created' with its error history: result received:", &task)
+		t.FailNow()
+	}
+}
+
+func TestSqliteTaskHistory(t *testing.T) {
+	m, err := taskmanager.New(taskmanager.WithDataURL(TaskManagerSqliteTestDataUrl),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType": taskmanager.DefaultTaskWorkflow,
+		}))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	err = m.Open()
+	if err != nil {
+		log.Println(err)
+		t.FailNow()
+	}
+	defer m.Close()
+
+	completed, _ := m.CreateTask(testTask)
+	_ = m.StartTask(completed.Id)
+	err = m.NotifyTaskWaitStatusResult(completed.Id, "success", "approved by ops")
+	if err != nil {
+		log.Println("taskmanager.NotifyTaskWaitStatusResult:", err)
+		t.FailNow()
+	}
+
+	failed, _ := m.CreateTask(testTask)
+	_ = m.StartTask(failed.Id)
+	_ = m.NotifyTaskWaitStatusResult(failed.Id, "error", "rejected by ops")
+
+	for id, want := range map[int][]string{
+		completed.Id: {"Created -> Active: ", "Active -> Waiting: ", "Waiting -> Complete: approved by ops"},
+		failed.Id:    {"Created -> Active: ", "Active -> Waiting: ", "Waiting -> Error: rejected by ops"},
+	} {
+		history, err := m.FindTaskHistory(id)
+		if err != nil {
+			log.Println("taskmanager.FindTaskHistory:", err)
+			t.FailNow()
+		}
+
+		var got []string
+		for _, h := range history {
+			if h.TaskId != id || h.Actor == "" || h.CreatedAt.IsZero() {
+				log.Println("expected a complete history record: result received:", h)
+				t.FailNow()
+			}
+			got = append(got, h.FromStatus+" -> "+h.ToStatus+": "+h.Message)
+		}
+		if !reflect.DeepEqual(got, want) {
+			log.Println("expected task history", want, ": result received:", got)
+			t.FailNow()
+		}
+	}
+}
+
+func TestSqliteConcurrentModification(t *testing.T) {
+	m, err := taskmanager.New(taskmanager.WithDataURL(TaskManagerSqliteTestDataUrl),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType": taskmanager.DefaultTaskWorkflow,
+		}))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	err = m.Open()
+	if err != nil {
+		log.Println(err)
+		t.FailNow()
+	}
+	defer m.Close()
+
+	task, _ := m.CreateTask(testTask)
+	first, _ := m.FindTask(task.Id)
+	second, _ := m.FindTask(task.Id)
+
+	first.Message = "first"
+	err = m.UpdateTask(first)
+	if err != nil {
+		log.Println("taskmanager.UpdateTask:", err)
+		t.FailNow()
+	}
+
+	// The second update was made to a version that no longer exists
+	second.Message = "second"
+	err = m.UpdateTask(second)
+	if !errors.Is(err, taskmanager.ErrConcurrentModification) {
+		log.Println("expected ErrConcurrentModification: result received:", err)
+		t.FailNow()
+	}
+
+	task, _ = m.FindTask(task.Id)
+	if task.Message != "first" || task.Version != first.Version+1 {
+		log.Println("expected only the first update to be written: result received:", &task)
+		t.FailNow()
+	}
+
+	// A notification for a task that has moved on since it was read fails
+	// without advancing it again
+	_ = m.StartTask(task.Id)
+	waiting, _ := m.FindTask(task.Id)
+	err = m.NotifyTaskWaitStatusResult(waiting.Id, "success", "")
+	if err != nil {
+		log.Println("taskmanager.NotifyTaskWaitStatusResult:", err)
+		t.FailNow()
+	}
+	waiting.Status = "Error"
+	err = m.UpdateTask(waiting)
+	if !errors.Is(err, taskmanager.ErrConcurrentModification) {
+		log.Println("expected ErrConcurrentModification: result received:", err)
+		t.FailNow()
+	}
+
+	history, _ := m.FindTaskHistory(task.Id)
+	task, _ = m.FindTask(task.Id)
+	if task.Status != "Complete" || len(history) != 3 {
+		log.Println("expected task to advance exactly once to 'Complete': result received:", &task, history)
+		t.FailNow()
+	}
+
+	// A deleted task is missing rather than concurrently modified
+	err = m.DeleteTask(task.Id)
+	if err != nil {
+		log.Println("taskmanager.DeleteTask:", err)
+		t.FailNow()
+	}
+	err = m.UpdateTask(task)
+	if !errors.Is(err, taskmanager.ErrTaskNotFound) || errors.Is(err, taskmanager.ErrConcurrentModification) {
+		log.Println("expected ErrTaskNotFound updating a deleted task: result received:", err)
+		t.FailNow()
+	}
+	err = m.DeleteTask(task.Id)
+	if !errors.Is(err, taskmanager.ErrTaskNotFound) {
+		log.Println("expected ErrTaskNotFound deleting a deleted task: result received:", err)
+		t.FailNow()
+	}
+}
+
+func TestSqliteTaskContext(t *testing.T) {
+	m, err := taskmanager.New(taskmanager.WithDataURL(TaskManagerSqliteTestDataUrl),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType": taskmanager.DefaultTaskWorkflow,
+		}))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	err = m.Open()
+	if err != nil {
+		log.Println(err)
+		t.FailNow()
+	}
+	defer m.Close()
+
+	task, err := m.CreateTaskContext(context.Background(), testTask)
+	if err != nil {
+		log.Println("taskmanager.CreateTaskContext:", err)
+		t.FailNow()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = m.FindTaskContext(ctx, task.Id)
+	if !errors.Is(err, context.Canceled) {
+		log.Println("expected context.Canceled from FindTaskContext: result received:", err)
+		t.FailNow()
+	}
+
+	err = m.StartTaskContext(ctx, task.Id)
+	if !errors.Is(err, context.Canceled) {
+		log.Println("expected context.Canceled from StartTaskContext: result received:", err)
+		t.FailNow()
+	}
+
+	task, _ = m.FindTask(task.Id)
+	if task.Status != "Created" || task.LockedBy != "" {
+		log.Println("expected the task to be left unclaimed in 'Created': result received:", &task)
+		t.FailNow()
+	}
+}
+
+func TestSqliteStatusChangedAt(t *testing.T) {
+	m, err := taskmanager.New(taskmanager.WithDataURL(TaskManagerSqliteTestDataUrl),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType": taskmanager.DefaultTaskWorkflow,
+		}))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	err = m.Open()
+	if err != nil {
+		log.Println(err)
+		t.FailNow()
+	}
+	defer m.Close()
+
+	task, _ := m.CreateTask(testTask)
+	created, _ := m.FindTask(task.Id)
+	if created.StatusChangedAt.IsZero() {
+		log.Println("expected StatusChangedAt to be set when the task is created")
+		t.FailNow()
+	}
+
+	// An update that keeps the status keeps StatusChangedAt
+	time.Sleep(10 * time.Millisecond)
+	created.Message = "updated"
+	_ = m.UpdateTask(created)
+	updated, _ := m.FindTask(task.Id)
+	if !updated.StatusChangedAt.Equal(created.StatusChangedAt) {
+		log.Println("expected StatusChangedAt to be kept when the status is not changed:", &updated)
+		t.FailNow()
+	}
+
+	_ = m.StartTask(task.Id)
+	started, _ := m.FindTask(task.Id)
+	if !started.StatusChangedAt.After(created.StatusChangedAt) {
+		log.Println("expected StatusChangedAt to change with the status:", &started)
+		t.FailNow()
+	}
+}
+
+func TestSqliteQualifiedTable(t *testing.T) {
+	m, err := taskmanager.New(taskmanager.WithDataURL(TaskManagerSqliteTestDataUrl),
+		taskmanager.WithTable("main.qualified_tasks"),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType": taskmanager.DefaultTaskWorkflow,
+		}))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	err = m.Open()
+	if err != nil {
+		log.Println(err)
+		t.FailNow()
+	}
+	defer m.Close()
+
+	task, _ := m.CreateTask(testTask)
+	created, _ := m.FindTask(task.Id)
+
+	// The updated_at trigger runs against the qualified table
+	time.Sleep(10 * time.Millisecond)
+	err = m.StartTask(task.Id)
+	if err != nil {
+		log.Println("taskmanager.StartTask:", err)
+		t.FailNow()
+	}
+	task, _ = m.FindTask(task.Id)
+	if task.Status != "Waiting" || !task.UpdatedAt.After(created.UpdatedAt) {
+		log.Println("expected a 'Waiting' task with a later UpdatedAt: result received:", &task)
+		t.FailNow()
+	}
+
+	history, _ := m.FindTaskHistory(task.Id)
+	if len(history) != 2 {
+		log.Println("expected 2 transitions in main.qualified_tasks_history: result received:", history)
+		t.FailNow()
+	}
+}
@@ -2,13 +2,13 @@ package test
 
 import (
 	"context"
-	"database/sql"
+	"errors"
 	"github.com/tnyidea/taskmanager-go/taskmanager"
 	"log"
 	"testing"
 )
 
-var testTaskManager taskmanager.TaskManager
+var testTaskManager *taskmanager.TaskManager
 
 var testTask = taskmanager.Task{
 	Id:          0,
@@ -40,9 +40,15 @@ func TestCreateTableTaskManager(t *testing.T) {
 func TestInitializeTaskManager(t *testing.T) {
 	ctx := context.Background()
 	ctx = context.WithValue(ctx, taskmanager.ContextKey("testContextProperties"), testContextProperties)
-	testTaskManager = taskmanager.New(ctx, TaskManagerTestDataUrl, map[string]taskmanager.TaskWorkflowDefinition{
-		"TaskType": taskmanager.DefaultTaskWorkflow,
-	})
+	var err error
+	testTaskManager, err = taskmanager.New(taskmanager.WithContext(ctx), taskmanager.WithDataURL(TaskManagerTestDataUrl),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType": taskmanager.DefaultTaskWorkflow,
+		}))
+	if err != nil {
+		log.Println(err)
+		t.FailNow()
+	}
 }
 
 func TestFindAllTasks(t *testing.T) {
@@ -81,12 +87,22 @@ func TestUpdateTask(t *testing.T) {
 	want.Id = 1
 	want.TaskType = "DifferentType"
 
+	// Updates are made to the current version of the task
+	current, err := m.FindTask(want.Id)
+	if err != nil {
+		log.Println(err)
+		m.Close()
+		t.FailNow()
+	}
+	want.Version = current.Version
+
 	err = m.UpdateTask(want)
 	if err != nil {
 		log.Println(err)
 		m.Close()
 		t.FailNow()
 	}
+	want.Version++
 
 	task, err := m.FindTask(want.Id)
 	if err != nil {
@@ -96,6 +112,11 @@ func TestUpdateTask(t *testing.T) {
 	}
 	m.Close()
 
+	// Record timestamps are maintained by the database
+	want.CreatedAt = task.CreatedAt
+	want.UpdatedAt = task.UpdatedAt
+	want.StatusChangedAt = task.StatusChangedAt
+
 	log.Println(&task)
 	log.Println(&want)
 
@@ -125,7 +146,7 @@ func TestDeleteTask(t *testing.T) {
 
 	_, err = m.FindTask(id)
 	if err != nil {
-		if err != sql.ErrNoRows {
+		if !errors.Is(err, taskmanager.ErrTaskNotFound) {
 			log.Println(err)
 			m.Close()
 			t.FailNow()
@@ -165,8 +186,12 @@ func TestCreateAndFindNullTask(t *testing.T) {
 
 	want := nullTask
 	want.Id = id
+	want.Version = 1
 	want.Status = "Created"
 	want.Timeout = -1
+	want.CreatedAt = task.CreatedAt
+	want.UpdatedAt = task.UpdatedAt
+	want.StatusChangedAt = task.StatusChangedAt
 
 	if task.String() != want.String() {
 		log.Println("expected FindTask result does not match nullTask")
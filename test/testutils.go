@@ -37,7 +37,8 @@ func dropTableTaskManager() error {
 	dropTableSQL := `
         DROP TRIGGER set_task_manager_updated_at_timestamp ON task_manager;
         DROP FUNCTION get_updated_at_timestamp();
-        DROP TABLE task_manager;`
+        DROP TABLE task_manager;
+        DROP TABLE task_manager_history;`
 
 	d, err := newDBConnection(TaskManagerTestDataUrl)
 	if err != nil {
@@ -0,0 +1,1048 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tnyidea/taskmanager-go/taskmanager"
+	"log"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitingTaskWorkflow(ctx context.Context) *taskmanager.TaskWorkflow {
+	w := taskmanager.DefaultTaskWorkflow(ctx)
+	w.Timeouts["Waiting"] = 1
+	return w
+}
+
+// failingTaskWorkflow fails every attempt at the Active status
+func failingTaskWorkflow(ctx context.Context) *taskmanager.TaskWorkflow {
+	w := taskmanager.DefaultTaskWorkflow(ctx)
+	w.Handlers["Active"] = []taskmanager.TaskWorkflowHandler{
+		func(w *taskmanager.TaskWorkflow) error {
+			return errors.New("failing handler")
+		},
+		taskmanager.NextStatus,
+	}
+	w.Retries = map[string]taskmanager.RetryPolicy{
+		"Active": {MaxAttempts: 2, BaseDelay: 10 * time.Millisecond},
+	}
+	return w
+}
+
+// runWorkerUntilStatus runs a Worker, which makes the retries of rescheduled
+// tasks, until the task reaches status
+func runWorkerUntilStatus(t *testing.T, m *taskmanager.TaskManager, id int, status string) taskmanager.Task {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := m.NewWorker(1)
+	w.PollInterval = 10 * time.Millisecond
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		task, _ := m.FindTask(id)
+		if task.Status == status {
+			return task
+		}
+		if time.Now().After(deadline) {
+			log.Println("expected worker to run task", id, "to '"+status+"': result received:", &task)
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSweepTimeouts(t *testing.T) {
+	store := taskmanager.NewMemoryTaskStore()
+	m, err := taskmanager.New(taskmanager.WithStore(store),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType": waitingTaskWorkflow,
+		}))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	_ = m.Open()
+	defer m.Close()
+
+	task, err := m.CreateTask(testTask)
+	if err != nil {
+		log.Println("taskmanager.CreateTask:", err)
+		t.FailNow()
+	}
+	id := task.Id
+
+	err = m.StartTask(id)
+	if err != nil {
+		log.Println("taskmanager.StartTask:", err)
+		t.FailNow()
+	}
+
+	// Nothing has timed out yet
+	err = m.SweepTimeouts()
+	if err != nil {
+		log.Println("taskmanager.SweepTimeouts:", err)
+		t.FailNow()
+	}
+	task, _ = m.FindTask(id)
+	if task.Status != "Waiting" {
+		log.Println("expected task status 'Waiting' before the timeout: result received:", task.Status)
+		t.FailNow()
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	// Writing the lease, as a claim or Heartbeat does, does not restart the timeout
+	_, err = store.ClaimTask(context.Background(), taskmanager.Eq("id", id), "another owner", time.Minute)
+	if err != nil {
+		log.Println("ClaimTask:", err)
+		t.FailNow()
+	}
+	_ = store.ReleaseTask(context.Background(), id, "another owner")
+
+	err = m.SweepTimeouts()
+	if err != nil {
+		log.Println("taskmanager.SweepTimeouts:", err)
+		t.FailNow()
+	}
+	task, _ = m.FindTask(id)
+	if task.Status != "Timeout" {
+		log.Println("expected task status 'Timeout' after the timeout: result received:", task.Status)
+		t.FailNow()
+	}
+}
+
+func TestSweepRescheduledTask(t *testing.T) {
+	var timeouts int32
+	now := time.Now()
+	m, err := taskmanager.New(taskmanager.WithStore(taskmanager.NewMemoryTaskStore()),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType": func(ctx context.Context) *taskmanager.TaskWorkflow {
+				w := taskmanager.DefaultTaskWorkflow(ctx)
+				w.Handlers["Active"] = []taskmanager.TaskWorkflowHandler{
+					func(w *taskmanager.TaskWorkflow) error {
+						return taskmanager.RetryAfter(errors.New("rate limited"), 20*time.Millisecond)
+					},
+				}
+				w.Handlers["Timeout"] = []taskmanager.TaskWorkflowHandler{
+					func(w *taskmanager.TaskWorkflow) error {
+						atomic.AddInt32(&timeouts, 1)
+						return nil
+					},
+				}
+				return w
+			},
+		}),
+		taskmanager.WithClock(func() time.Time { return now }))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	_ = m.Open()
+	defer m.Close()
+
+	task, _ := m.CreateTask(testTask)
+	_ = m.StartTask(task.Id)
+
+	// The task times out while it holds the lease of its rescheduled retry
+	now = now.Add(time.Hour)
+	_ = m.SweepTimeouts()
+
+	// A worker polling after the lease has expired leaves the task alone
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	w := m.NewWorker(1)
+	w.PollInterval = 10 * time.Millisecond
+	w.Run(ctx)
+
+	task, _ = m.FindTask(task.Id)
+	if task.Status != "Timeout" || task.LockedBy != "" || atomic.LoadInt32(&timeouts) != 1 {
+		log.Println("expected the Timeout handlers to run once for an unlocked task: result received:",
+			atomic.LoadInt32(&timeouts), &task)
+		t.FailNow()
+	}
+}
+
+func TestScheduleRecurringTasks(t *testing.T) {
+	m := newMemoryTaskManager(t)
+	_ = m.Open()
+	defer m.Close()
+
+	recurringTask := testTask
+	recurringTask.Recurring = true
+	recurringTask.RecurrenceInterval = 3600
+
+	task, err := m.CreateTask(recurringTask)
+	if err != nil {
+		log.Println("taskmanager.CreateTask:", err)
+		t.FailNow()
+	}
+	id := task.Id
+
+	// A recurring task that would run on every tick is rejected
+	spinning := recurringTask
+	spinning.RecurrenceInterval = 0
+	_, err = m.CreateTask(spinning)
+	if !errors.Is(err, taskmanager.ErrInvalidState) {
+		log.Println("expected ErrInvalidState for a recurring task without an interval: result received:", err)
+		t.FailNow()
+	}
+
+	// A new recurring task is due immediately
+	err = m.ScheduleRecurringTasks()
+	if err != nil {
+		log.Println("taskmanager.ScheduleRecurringTasks:", err)
+		t.FailNow()
+	}
+	task, _ = m.FindTask(id)
+	if task.Status != "Waiting" {
+		log.Println("expected recurring task status 'Waiting' after scheduling: result received:", task.Status)
+		t.FailNow()
+	}
+
+	err = m.NotifyTaskWaitStatusResult(id, "success", "")
+	if err != nil {
+		log.Println("taskmanager.NotifyTaskWaitStatusResult:", err)
+		t.FailNow()
+	}
+
+	tasks, err := m.FindAllRecurringTasks(&taskmanager.FindOptions{Where: taskmanager.Eq("status", "Created")})
+	if err != nil || len(tasks) != 1 {
+		log.Println("expected one recurring task to be created for the next run: result received:", tasks, err)
+		t.FailNow()
+	}
+	next := tasks[0]
+	if next.LockedBy != "" || !next.LeaseExpiresAt.IsZero() {
+		log.Println("expected the next recurring task not to be locked: result received:", &next)
+		t.FailNow()
+	}
+	if next.NextRunAt.Before(time.Now().Add(59 * time.Minute)) {
+		log.Println("expected the next recurring task to run after its interval: result received:", next.NextRunAt)
+		t.FailNow()
+	}
+
+	// The next task is not due yet, so neither the scheduler nor StartTask runs it
+	err = m.ScheduleRecurringTasks()
+	if err != nil {
+		log.Println("taskmanager.ScheduleRecurringTasks:", err)
+		t.FailNow()
+	}
+	err = m.StartTask(next.Id)
+	if err != nil {
+		log.Println("taskmanager.StartTask:", err)
+		t.FailNow()
+	}
+	next, _ = m.FindTask(next.Id)
+	if next.Status != "Created" {
+		log.Println("expected recurring task that is not due to remain 'Created': result received:", next.Status)
+		t.FailNow()
+	}
+}
+
+func TestTerminalStatusEndsWorkflow(t *testing.T) {
+	endingTaskWorkflow := func(handler taskmanager.TaskWorkflowHandler) taskmanager.TaskWorkflowDefinition {
+		return func(ctx context.Context) *taskmanager.TaskWorkflow {
+			return &taskmanager.TaskWorkflow{
+				Context:  ctx,
+				Sequence: []string{"Created", "Complete"},
+				Handlers: map[string][]taskmanager.TaskWorkflowHandler{
+					"Created":  {taskmanager.NextStatus},
+					"Complete": {handler},
+				},
+			}
+		}
+	}
+	m, err := taskmanager.New(taskmanager.WithStore(taskmanager.NewMemoryTaskStore()),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"Advance": endingTaskWorkflow(taskmanager.NextStatus),
+			"Return": endingTaskWorkflow(func(w *taskmanager.TaskWorkflow) error {
+				return nil
+			}),
+		}))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	_ = m.Open()
+	defer m.Close()
+
+	// A recurring task ends at the last status without EndWorkflow, and its
+	// series goes on
+	for _, taskType := range []string{"Advance", "Return"} {
+		recurring := testTask
+		recurring.TaskType = taskType
+		recurring.Recurring = true
+		recurring.RecurrenceInterval = 60
+		recurring.NextRunAt = time.Now().Add(-time.Minute)
+		task, _ := m.CreateTask(recurring)
+		err = m.StartTask(task.Id)
+		if err != nil {
+			log.Println("taskmanager.StartTask:", err)
+			t.FailNow()
+		}
+		task, _ = m.FindTask(task.Id)
+		next, _ := m.FindAllTasksByTypeAndStatus(taskType, "Created", nil)
+		if task.Status != "Complete" || len(next) != 1 || !next[0].Recurring {
+			log.Println("expected a 'Complete' "+taskType+" task and the next run of its series: result received:", &task, next)
+			t.FailNow()
+		}
+	}
+}
+
+func TestScheduleCronTasks(t *testing.T) {
+	m := newMemoryTaskManager(t)
+	_ = m.Open()
+	defer m.Close()
+
+	cronTask := testTask
+	cronTask.Recurring = true
+	cronTask.Schedule = "CRON_TZ=UTC 0 2 * * 1-5"
+
+	task, err := m.CreateTask(cronTask)
+	if err != nil {
+		log.Println("taskmanager.CreateTask:", err)
+		t.FailNow()
+	}
+	nextRunAt := task.NextRunAt.UTC()
+	if !nextRunAt.After(time.Now()) || nextRunAt.Hour() != 2 ||
+		nextRunAt.Weekday() == time.Saturday || nextRunAt.Weekday() == time.Sunday {
+		log.Println("expected cron task to first run on a weekday at 02:00 UTC: result received:", nextRunAt)
+		t.FailNow()
+	}
+
+	cronTask.Schedule = "not a schedule"
+	_, err = m.CreateTask(cronTask)
+	if err == nil {
+		log.Println("expected CreateTask to reject an invalid schedule")
+		t.FailNow()
+	}
+}
+
+func TestScheduleCatchUp(t *testing.T) {
+	missedTask := testTask
+	missedTask.Recurring = true
+	missedTask.Schedule = "0 * * * *"
+	missedTask.NextRunAt = time.Now().Truncate(time.Hour).Add(-3 * time.Hour)
+
+	// Skipping missed runs reschedules the task without running it
+	m := newMemoryTaskManager(t, taskmanager.WithCatchUp(taskmanager.CatchUpSkip))
+	_ = m.Open()
+
+	task, _ := m.CreateTask(missedTask)
+	err := m.ScheduleRecurringTasks()
+	if err != nil {
+		log.Println("taskmanager.ScheduleRecurringTasks:", err)
+		t.FailNow()
+	}
+	task, _ = m.FindTask(task.Id)
+	if task.Status != "Created" || !task.NextRunAt.After(time.Now()) {
+		log.Println("expected skipped task to be rescheduled without running: result received:", &task)
+		t.FailNow()
+	}
+	m.Close()
+
+	// Running every missed run schedules the next task from the missed run
+	m = newMemoryTaskManager(t, taskmanager.WithCatchUp(taskmanager.CatchUpRunAll))
+	_ = m.Open()
+	defer m.Close()
+
+	task, _ = m.CreateTask(missedTask)
+	err = m.ScheduleRecurringTasks()
+	if err != nil {
+		log.Println("taskmanager.ScheduleRecurringTasks:", err)
+		t.FailNow()
+	}
+	err = m.NotifyTaskWaitStatusResult(task.Id, "success", "")
+	if err != nil {
+		log.Println("taskmanager.NotifyTaskWaitStatusResult:", err)
+		t.FailNow()
+	}
+
+	tasks, _ := m.FindAllRecurringTasks(&taskmanager.FindOptions{Where: taskmanager.Eq("status", "Created")})
+	if len(tasks) != 1 || !tasks[0].NextRunAt.Equal(missedTask.NextRunAt.Add(time.Hour)) {
+		log.Println("expected the next task to run an hour after the missed run: result received:", tasks)
+		t.FailNow()
+	}
+}
+
+func TestWorkerRunsCreatedTasks(t *testing.T) {
+	m := newMemoryTaskManager(t)
+	_ = m.Open()
+	defer m.Close()
+
+	var ids []int
+	for i := 0; i < 5; i++ {
+		task, err := m.CreateTask(testTask)
+		if err != nil {
+			log.Println("taskmanager.CreateTask:", err)
+			t.FailNow()
+		}
+		ids = append(ids, task.Id)
+	}
+	otherTask := testTask
+	otherTask.TaskType = "OtherType"
+	other, _ := m.CreateTask(otherTask)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := m.NewWorker(3)
+	w.PollInterval = 10 * time.Millisecond
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, id := range ids {
+		for {
+			task, _ := m.FindTask(id)
+			if task.Status == "Waiting" {
+				break
+			}
+			if time.Now().After(deadline) {
+				log.Println("expected worker to run task", id, "to 'Waiting': result received:", task.Status)
+				t.FailNow()
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	cancel()
+	<-done
+
+	// Tasks without a workflow are never claimed
+	task, _ := m.FindTask(other.Id)
+	if task.Status != "Created" {
+		log.Println("expected task without a workflow to remain 'Created': result received:", task.Status)
+		t.FailNow()
+	}
+
+	// A task that has been claimed cannot be started again
+	err := m.StartTask(ids[0])
+	if err == nil {
+		log.Println("expected StartTask to fail for a task that has already been started")
+		t.FailNow()
+	}
+}
+
+func TestLeaseReclaim(t *testing.T) {
+	store := taskmanager.NewMemoryTaskStore()
+
+	// The first Active handler hangs as if its process had died
+	hang := make(chan struct{})
+	defer close(hang)
+	var calls int32
+	hangingTaskWorkflow := func(ctx context.Context) *taskmanager.TaskWorkflow {
+		w := taskmanager.DefaultTaskWorkflow(ctx)
+		w.Handlers["Active"] = []taskmanager.TaskWorkflowHandler{
+			func(w *taskmanager.TaskWorkflow) error {
+				if atomic.AddInt32(&calls, 1) == 1 {
+					<-hang
+				}
+				return w.Heartbeat()
+			},
+			taskmanager.NextStatus,
+		}
+		return w
+	}
+	workflows := map[string]taskmanager.TaskWorkflowDefinition{
+		"TaskType": hangingTaskWorkflow,
+	}
+
+	dead, err := taskmanager.New(taskmanager.WithStore(store), taskmanager.WithWorkflows(workflows),
+		taskmanager.WithLeaseDuration(50*time.Millisecond))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	task, _ := dead.CreateTask(testTask)
+	go func() {
+		_ = dead.StartTask(task.Id)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	task, _ = dead.FindTask(task.Id)
+	if task.Status != "Active" || task.LockedBy == "" {
+		log.Println("expected hanging task to be 'Active' and locked: result received:", &task)
+		t.FailNow()
+	}
+
+	m, err := taskmanager.New(taskmanager.WithStore(store), taskmanager.WithWorkflows(workflows))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := m.NewWorker(1)
+	w.PollInterval = 10 * time.Millisecond
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		task, _ = m.FindTask(task.Id)
+		if task.Status == "Waiting" {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Println("expected expired task to be reclaimed and resumed to 'Waiting': result received:", &task)
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if task.LockedBy != "" {
+		log.Println("expected lease to be released once the task is waiting: result received:", task.LockedBy)
+		t.FailNow()
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	blockingTaskWorkflow := func(ctx context.Context) *taskmanager.TaskWorkflow {
+		w := taskmanager.DefaultTaskWorkflow(ctx)
+		w.Handlers["Active"] = []taskmanager.TaskWorkflowHandler{
+			func(w *taskmanager.TaskWorkflow) error {
+				<-release
+				return nil
+			},
+			taskmanager.NextStatus,
+		}
+		return w
+	}
+	store := taskmanager.NewMemoryTaskStore()
+	m, err := taskmanager.New(taskmanager.WithStore(store), taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+		"TaskType": blockingTaskWorkflow,
+	}))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+
+	// Shutdown waits for running handlers to finish
+	task, _ := m.CreateTask(testTask)
+	go func() {
+		_ = m.StartTask(task.Id)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	err = m.Shutdown(context.Background())
+	if err != nil {
+		log.Println("taskmanager.Shutdown:", err)
+		t.FailNow()
+	}
+	task, _ = store.FindTask(context.Background(), task.Id)
+	if task.Status != "Waiting" || task.LockedBy != "" {
+		log.Println("expected Shutdown to wait for the task to reach 'Waiting': result received:", &task)
+		t.FailNow()
+	}
+
+	// No new work is accepted after Shutdown
+	next, _ := store.CreateTask(context.Background(), testTask)
+	err = m.StartTask(next.Id)
+	if err == nil {
+		log.Println("expected StartTask to fail after Shutdown")
+		t.FailNow()
+	}
+}
+
+func TestShutdownClosedStore(t *testing.T) {
+	m, err := taskmanager.New(taskmanager.WithDataURL(TaskManagerSqliteTestDataUrl))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+
+	// The store is opened lazily from the data URL, so there is none to close yet
+	err = m.Shutdown(context.Background())
+	if err != nil {
+		log.Println("expected Shutdown before Open to succeed: result received:", err)
+		t.FailNow()
+	}
+
+	m, _ = taskmanager.New(taskmanager.WithDataURL(TaskManagerSqliteTestDataUrl))
+	_ = m.Open()
+	m.Close()
+	err = m.Shutdown(context.Background())
+	if err != nil {
+		log.Println("expected Shutdown after Close to succeed: result received:", err)
+		t.FailNow()
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	hangingTaskWorkflow := func(ctx context.Context) *taskmanager.TaskWorkflow {
+		w := taskmanager.DefaultTaskWorkflow(ctx)
+		w.Handlers["Active"] = []taskmanager.TaskWorkflowHandler{
+			func(w *taskmanager.TaskWorkflow) error {
+				<-hang
+				return nil
+			},
+		}
+		return w
+	}
+	store := taskmanager.NewMemoryTaskStore()
+	m, err := taskmanager.New(taskmanager.WithStore(store), taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+		"TaskType": hangingTaskWorkflow,
+	}))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+
+	task, _ := m.CreateTask(testTask)
+	go func() {
+		_ = m.StartTask(task.Id)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = m.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		log.Println("expected Shutdown to report the task still running at the deadline: result received:", err)
+		t.FailNow()
+	}
+
+	// The unfinished task can be reclaimed straight away
+	task, _ = store.FindTask(context.Background(), task.Id)
+	if task.Status != "Active" || task.LeaseExpiresAt.After(time.Now()) {
+		log.Println("expected unfinished task to stay 'Active' with an expired lease: result received:", &task)
+		t.FailNow()
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var calls int32
+	flakyTaskWorkflow := func(ctx context.Context) *taskmanager.TaskWorkflow {
+		w := taskmanager.DefaultTaskWorkflow(ctx)
+		w.Handlers["Active"] = []taskmanager.TaskWorkflowHandler{
+			func(w *taskmanager.TaskWorkflow) error {
+				// Fail the first two attempts only
+				if atomic.AddInt32(&calls, 1) <= 2 {
+					return errors.New("flaky handler")
+				}
+				return nil
+			},
+			taskmanager.NextStatus,
+		}
+		w.Retries = map[string]taskmanager.RetryPolicy{
+			"Active": {MaxAttempts: 3, BaseDelay: 10 * time.Millisecond},
+		}
+		return w
+	}
+	m, err := taskmanager.New(taskmanager.WithStore(taskmanager.NewMemoryTaskStore()),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"Flaky":   flakyTaskWorkflow,
+			"Failing": failingTaskWorkflow,
+		}))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	_ = m.Open()
+	defer m.Close()
+
+	flaky := testTask
+	flaky.TaskType = "Flaky"
+	task, _ := m.CreateTask(flaky)
+	err = m.StartTask(task.Id)
+	if err != nil {
+		log.Println("taskmanager.StartTask:", err)
+		t.FailNow()
+	}
+
+	// The failed attempt is rescheduled rather than retried before StartTask returns
+	task, _ = m.FindTask(task.Id)
+	if task.Status != "Active" || task.Attempt != 1 || atomic.LoadInt32(&calls) != 1 {
+		log.Println("expected flaky task to be rescheduled after its first attempt: result received:", &task)
+		t.FailNow()
+	}
+	task = runWorkerUntilStatus(t, m, task.Id, "Waiting")
+	if task.Attempt != 0 || atomic.LoadInt32(&calls) != 3 {
+		log.Println("expected flaky task to reach 'Waiting' on its third attempt: result received:", &task)
+		t.FailNow()
+	}
+
+	failing := testTask
+	failing.TaskType = "Failing"
+	task, _ = m.CreateTask(failing)
+	err = m.StartTask(task.Id)
+	if err != nil {
+		log.Println("taskmanager.StartTask:", err)
+		t.FailNow()
+	}
+	task = runWorkerUntilStatus(t, m, task.Id, "DeadLetter")
+	if task.Status != "DeadLetter" || task.Attempt != 2 || len(task.Failures) != 2 {
+		log.Println("expected failing task to be 'DeadLetter' after 2 attempts: result received:", &task)
+		t.FailNow()
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := taskmanager.RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    time.Second,
+	}
+	for n, want := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		5: time.Second,
+	} {
+		if p.Delay(n) != want {
+			log.Println("expected delay", want, "after attempt", n, ": result received:", p.Delay(n))
+			t.FailNow()
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.Delay(2)
+		if d < 100*time.Millisecond || d > 300*time.Millisecond {
+			log.Println("expected jittered delay within 50% of 200ms: result received:", d)
+			t.FailNow()
+		}
+	}
+}
+
+func TestRetryErrorClassification(t *testing.T) {
+	defaultRetryPolicy := taskmanager.DefaultRetryPolicy
+	defer func() { taskmanager.DefaultRetryPolicy = defaultRetryPolicy }()
+	taskmanager.DefaultRetryPolicy.BaseDelay = 10 * time.Millisecond
+
+	var calls int32
+	classifiedTaskWorkflow := func(ctx context.Context) *taskmanager.TaskWorkflow {
+		w := taskmanager.DefaultTaskWorkflow(ctx)
+		w.Handlers["Active"] = []taskmanager.TaskWorkflowHandler{
+			func(w *taskmanager.TaskWorkflow) error {
+				n := atomic.AddInt32(&calls, 1)
+				switch string(w.GetTask().Properties) {
+				case "permanent":
+					return taskmanager.Permanent(errors.New("invalid input"))
+				case "retryable":
+					if n == 1 {
+						return taskmanager.Retryable(errors.New("network blip"))
+					}
+				case "retryAfter":
+					if n == 1 {
+						return taskmanager.RetryAfter(errors.New("rate limited"), 50*time.Millisecond)
+					}
+				}
+				return nil
+			},
+			taskmanager.NextStatus,
+		}
+		w.Retries = map[string]taskmanager.RetryPolicy{}
+		if string(w.GetTask().Properties) == "permanent" {
+			w.Retries["Active"] = taskmanager.RetryPolicy{MaxAttempts: 3}
+		}
+		return w
+	}
+	m, err := taskmanager.New(taskmanager.WithStore(taskmanager.NewMemoryTaskStore()),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType": classifiedTaskWorkflow,
+		}))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	_ = m.Open()
+	defer m.Close()
+
+	// Permanent errors fail the task despite its RetryPolicy
+	permanent := testTask
+	permanent.Properties = []byte("permanent")
+	task, _ := m.CreateTask(permanent)
+	_ = m.StartTask(task.Id)
+	task, _ = m.FindTask(task.Id)
+	if task.Status != "Error" || atomic.LoadInt32(&calls) != 1 {
+		log.Println("expected permanent error to fail the task on the first attempt: result received:", &task)
+		t.FailNow()
+	}
+
+	// Retryable errors are retried by DefaultRetryPolicy
+	atomic.StoreInt32(&calls, 0)
+	retryable := testTask
+	retryable.Properties = []byte("retryable")
+	task, _ = m.CreateTask(retryable)
+	err = m.StartTask(task.Id)
+	if err != nil {
+		log.Println("taskmanager.StartTask:", err)
+		t.FailNow()
+	}
+	task = runWorkerUntilStatus(t, m, task.Id, "Waiting")
+	if atomic.LoadInt32(&calls) != 2 {
+		log.Println("expected retryable error to be retried: result received:", &task)
+		t.FailNow()
+	}
+
+	// RetryAfter reschedules the task for a worker
+	atomic.StoreInt32(&calls, 0)
+	retryAfter := testTask
+	retryAfter.Properties = []byte("retryAfter")
+	task, _ = m.CreateTask(retryAfter)
+	err = m.StartTask(task.Id)
+	if err != nil {
+		log.Println("taskmanager.StartTask:", err)
+		t.FailNow()
+	}
+	task, _ = m.FindTask(task.Id)
+	if task.Status != "Active" || task.Attempt != 1 || !task.LeaseExpiresAt.After(time.Now()) {
+		log.Println("expected task to be rescheduled with status 'Active': result received:", &task)
+		t.FailNow()
+	}
+	runWorkerUntilStatus(t, m, task.Id, "Waiting")
+}
+
+func approvalTaskWorkflow(ctx context.Context) *taskmanager.TaskWorkflow {
+	w := taskmanager.DefaultTaskWorkflow(ctx)
+	w.Transitions = map[string][]string{
+		"Waiting":  {"Approved", "Rejected"},
+		"Approved": {"Complete"},
+		"Rejected": {},
+	}
+	w.Handlers["Waiting"] = []taskmanager.TaskWorkflowHandler{
+		func(w *taskmanager.TaskWorkflow) error {
+			switch string(w.GetTask().Properties) {
+			case "approve":
+				return taskmanager.GoTo("Approved")
+			case "reject":
+				return taskmanager.GoTo("Rejected")
+			default:
+				return taskmanager.GoTo("Complete")
+			}
+		},
+	}
+	w.Handlers["Approved"] = []taskmanager.TaskWorkflowHandler{
+		taskmanager.NextStatus,
+	}
+	w.Handlers["Rejected"] = []taskmanager.TaskWorkflowHandler{
+		taskmanager.EndWorkflow,
+	}
+	return w
+}
+
+func TestBranchingTransitions(t *testing.T) {
+	m, err := taskmanager.New(taskmanager.WithStore(taskmanager.NewMemoryTaskStore()),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType": approvalTaskWorkflow,
+		}))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	_ = m.Open()
+	defer m.Close()
+
+	for properties, want := range map[string]string{
+		"approve": "Complete",
+		"reject":  "Rejected",
+		"skip":    "Error",
+	} {
+		task := testTask
+		task.Properties = []byte(properties)
+		task, _ = m.CreateTask(task)
+
+		err := m.StartTask(task.Id)
+		if (err != nil) != (want == "Error") {
+			log.Println("unexpected result from taskmanager.StartTask for", properties, ":", err)
+			t.FailNow()
+		}
+
+		task, _ = m.FindTask(task.Id)
+		if task.Status != want {
+			log.Println("expected task status '"+want+"' for", properties, ": result received:", task.Status)
+			t.FailNow()
+		}
+	}
+}
+
+func TestSweepTerminalStatus(t *testing.T) {
+	now := time.Now()
+	m, err := taskmanager.New(taskmanager.WithStore(taskmanager.NewMemoryTaskStore()),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType": approvalTaskWorkflow,
+		}),
+		taskmanager.WithClock(func() time.Time { return now }))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	_ = m.Open()
+	defer m.Close()
+
+	rejected := testTask
+	rejected.Properties = []byte("reject")
+	task, _ := m.CreateTask(rejected)
+	_ = m.StartTask(task.Id)
+	task, _ = m.FindTask(task.Id)
+	task.Timeout = 1
+	_ = m.UpdateTask(task)
+
+	// A task whose workflow has ended never times out
+	now = now.Add(time.Hour)
+	_ = m.SweepTimeouts()
+	task, _ = m.FindTask(task.Id)
+	if task.Status != "Rejected" {
+		log.Println("expected task status 'Rejected' after the sweep: result received:", task.Status)
+		t.FailNow()
+	}
+}
+
+func TestAmbiguousAdvance(t *testing.T) {
+	branchingWaitWorkflow := func(ctx context.Context) *taskmanager.TaskWorkflow {
+		w := taskmanager.DefaultTaskWorkflow(ctx)
+		w.Transitions = map[string][]string{
+			"Waiting":  {"Approved", "Rejected"},
+			"Approved": {},
+			"Rejected": {},
+		}
+		w.Handlers["Approved"] = []taskmanager.TaskWorkflowHandler{taskmanager.EndWorkflow}
+		w.Handlers["Rejected"] = []taskmanager.TaskWorkflowHandler{taskmanager.EndWorkflow}
+		return w
+	}
+	m, err := taskmanager.New(taskmanager.WithStore(taskmanager.NewMemoryTaskStore()),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType": branchingWaitWorkflow,
+		}))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	_ = m.Open()
+	defer m.Close()
+
+	task, _ := m.CreateTask(testTask)
+	_ = m.StartTask(task.Id)
+
+	// A notification cannot choose between Approved and Rejected, and must not
+	// fall back to the next status in Sequence
+	err = m.NotifyTaskWaitStatusResult(task.Id, "success", "")
+	if !errors.Is(err, taskmanager.ErrInvalidState) {
+		log.Println("expected ErrInvalidState advancing from a branching status: result received:", err)
+		t.FailNow()
+	}
+	task, _ = m.FindTask(task.Id)
+	if task.Status != "Error" {
+		log.Println("expected task status 'Error' after an ambiguous advance: result received:", task.Status)
+		t.FailNow()
+	}
+}
+
+func TestTaskActions(t *testing.T) {
+	var skipped int32
+	actionTaskWorkflow := func(ctx context.Context) *taskmanager.TaskWorkflow {
+		w := taskmanager.DefaultTaskWorkflow(ctx)
+		w.Handlers["Created"] = []taskmanager.TaskWorkflowHandler{
+			func(w *taskmanager.TaskWorkflow) error {
+				return taskmanager.Continue
+			},
+			// Wrapped actions are recognized
+			func(w *taskmanager.TaskWorkflow) error {
+				return fmt.Errorf("advancing: %w", taskmanager.NextStatus(w))
+			},
+		}
+		w.Handlers["Active"] = []taskmanager.TaskWorkflowHandler{
+			taskmanager.NextStatus,
+		}
+		w.Handlers["Waiting"] = []taskmanager.TaskWorkflowHandler{
+			taskmanager.WaitForNotify,
+			func(w *taskmanager.TaskWorkflow) error {
+				atomic.AddInt32(&skipped, 1)
+				return nil
+			},
+		}
+		return w
+	}
+	m, err := taskmanager.New(taskmanager.WithStore(taskmanager.NewMemoryTaskStore()),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType": actionTaskWorkflow,
+		}))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	_ = m.Open()
+	defer m.Close()
+
+	task, _ := m.CreateTask(testTask)
+	err = m.StartTask(task.Id)
+	if err != nil {
+		log.Println("taskmanager.StartTask:", err)
+		t.FailNow()
+	}
+
+	task, _ = m.FindTask(task.Id)
+	if task.Status != "Waiting" || atomic.LoadInt32(&skipped) != 0 {
+		log.Println("expected task to wait without running the handlers after WaitForNotify: result received:", &task)
+		t.FailNow()
+	}
+}
+
+func TestWorkflowValidation(t *testing.T) {
+	brokenTaskWorkflow := func(ctx context.Context) *taskmanager.TaskWorkflow {
+		w := taskmanager.DefaultTaskWorkflow(ctx)
+		w.Sequence = append(w.Sequence, "Archived")
+		w.Timeouts["Archive"] = 60
+		w.Transitions = map[string][]string{"Waiting": {"Complete", "Cancelled"}}
+		w.Handlers["Cancelled"] = []taskmanager.TaskWorkflowHandler{taskmanager.EndWorkflow}
+		return w
+	}
+
+	// Any handler may end the workflow at its final status
+	customEndTaskWorkflow := func(ctx context.Context) *taskmanager.TaskWorkflow {
+		w := taskmanager.DefaultTaskWorkflow(ctx)
+		w.Handlers["Complete"] = []taskmanager.TaskWorkflowHandler{
+			func(w *taskmanager.TaskWorkflow) error {
+				return taskmanager.End
+			},
+		}
+		return w
+	}
+
+	_, err := taskmanager.New(taskmanager.WithStore(taskmanager.NewMemoryTaskStore()),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType":  taskmanager.DefaultTaskWorkflow,
+			"CustomEnd": customEndTaskWorkflow,
+			"Broken":    brokenTaskWorkflow,
+		}))
+
+	var validationErr *taskmanager.ValidationError
+	if !errors.As(err, &validationErr) {
+		log.Println("expected a ValidationError: result received:", err)
+		t.FailNow()
+	}
+	want := []string{
+		"task type 'Broken': status 'Archived' has no Handlers",
+		"task type 'Broken': status 'Cancelled' has no next status, and needs Transitions " +
+			"(an empty entry if the workflow ends there)",
+		"task type 'Broken': Timeouts declared for unknown status 'Archive'",
+	}
+	if !reflect.DeepEqual(validationErr.Problems, want) {
+		log.Println("expected every problem to be listed: result received:", validationErr.Problems)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,133 @@
+package test
+
+import (
+	"context"
+	"github.com/tnyidea/taskmanager-go/taskmanager"
+	"log"
+	"testing"
+)
+
+func TestWorkflowDOT(t *testing.T) {
+	w := waitingTaskWorkflow(context.Background())
+	w.Retries = map[string]taskmanager.RetryPolicy{
+		"Active": {MaxAttempts: 3},
+	}
+
+	want := `digraph TaskWorkflow {
+    rankdir=LR;
+    node [shape=box, style=rounded];
+    start [shape=point];
+    start -> Created;
+    Created;
+    Active;
+    Waiting [peripheries=2, style="rounded,filled", fillcolor=yellow];
+    Complete [shape=doublecircle];
+    Error [shape=octagon];
+    Timeout [shape=octagon];
+    DeadLetter [shape=octagon];
+    Created -> Active;
+    Active -> Waiting;
+    Waiting -> Complete [label=notify];
+    Created -> Error [label=error, style=dashed];
+    Active -> Error [label=error, style=dashed];
+    Active -> Timeout [label="after 300s", style=dashed];
+    Active -> DeadLetter [label="after 3 attempts", style=dashed];
+    Waiting -> Error [label=error, style=dashed];
+    Waiting -> Timeout [label="after 1s", style=dashed];
+}
+`
+	got := w.DOT(&taskmanager.Task{Status: "Waiting"})
+	if got != want {
+		log.Println("unexpected DOT diagram: result received:\n" + got)
+		t.FailNow()
+	}
+
+	// Statuses named like the start point or a DOT keyword are told apart
+	w = &taskmanager.TaskWorkflow{
+		Sequence: []string{"start", "Node"},
+		Handlers: map[string][]taskmanager.TaskWorkflowHandler{
+			"start": {taskmanager.NextStatus},
+			"Node": {func(w *taskmanager.TaskWorkflow) error {
+				return taskmanager.End
+			}},
+		},
+	}
+	want = `digraph TaskWorkflow {
+    rankdir=LR;
+    node [shape=box, style=rounded];
+    _start [shape=point];
+    _start -> start;
+    start;
+    "Node" [shape=doublecircle];
+    Error [shape=octagon];
+    start -> "Node";
+    start -> Error [label=error, style=dashed];
+}
+`
+	got = w.DOT(nil)
+	if got != want {
+		log.Println("unexpected DOT diagram: result received:\n" + got)
+		t.FailNow()
+	}
+}
+
+func TestWorkflowMermaid(t *testing.T) {
+	w := approvalTaskWorkflow(context.Background())
+	w.Transitions["Approved"] = []string{"Sent to Customer"}
+	w.Transitions["Sent to Customer"] = []string{}
+	w.Handlers["Sent to Customer"] = []taskmanager.TaskWorkflowHandler{taskmanager.EndWorkflow}
+
+	want := `stateDiagram-v2
+    state "Sent to Customer" as Sent_to_Customer
+    [*] --> Created
+    Created --> Active
+    Active --> Waiting
+    Waiting --> Approved
+    Waiting --> Rejected
+    Approved --> Sent_to_Customer
+    Created --> Error : error
+    Active --> Error : error
+    Active --> Timeout : after 300s
+    Waiting --> Error : error
+    Approved --> Error : error
+    Complete --> [*]
+    Sent_to_Customer --> [*]
+    Rejected --> [*]
+    note right of Waiting : waits for notify
+    classDef current fill:#ff0,stroke:#333
+    class Approved current
+`
+	got := w.Mermaid(&taskmanager.Task{Status: "Approved"})
+	if got != want {
+		log.Println("unexpected Mermaid diagram: result received:\n" + got)
+		t.FailNow()
+	}
+
+	// Nothing is highlighted without a task
+	got = w.Mermaid(nil)
+	if got != want[:len(want)-len("    classDef current fill:#ff0,stroke:#333\n    class Approved current\n")] {
+		log.Println("unexpected Mermaid diagram without a task: result received:\n" + got)
+		t.FailNow()
+	}
+
+	// Statuses that only differ in characters Mermaid does not allow are told apart
+	w = &taskmanager.TaskWorkflow{
+		Sequence: []string{"In-Review", "In_Review"},
+		Handlers: map[string][]taskmanager.TaskWorkflowHandler{
+			"In-Review": {taskmanager.NextStatus},
+			"In_Review": {taskmanager.EndWorkflow},
+		},
+	}
+	want = `stateDiagram-v2
+    state "In-Review" as In_Review_
+    [*] --> In_Review_
+    In_Review_ --> In_Review
+    In_Review_ --> Error : error
+    In_Review --> [*]
+`
+	got = w.Mermaid(nil)
+	if got != want {
+		log.Println("unexpected Mermaid diagram: result received:\n" + got)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,111 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"github.com/tnyidea/taskmanager-go/taskmanager"
+	"log"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadTaskWorkflow(t *testing.T) {
+	var checks int32
+	registry := taskmanager.HandlerRegistry{
+		"checkRequest": func(w *taskmanager.TaskWorkflow) error {
+			// Fail the first check only
+			if atomic.AddInt32(&checks, 1) == 1 {
+				return errors.New("request service unavailable")
+			}
+			return nil
+		},
+		"decide": func(w *taskmanager.TaskWorkflow) error {
+			if string(w.GetTask().Properties) == "approve" {
+				return taskmanager.GoTo("Approved")
+			}
+			return taskmanager.GoTo("Rejected")
+		},
+	}
+
+	definition, err := taskmanager.LoadTaskWorkflowFile("approval_workflow.yaml", registry)
+	if err != nil {
+		log.Println("taskmanager.LoadTaskWorkflowFile:", err)
+		t.FailNow()
+	}
+
+	w := definition(context.Background())
+	if w.Retries["Active"].BaseDelay != 10*time.Millisecond || w.Timeouts["Active"] != 300 ||
+		!reflect.DeepEqual(w.Transitions["Waiting"], []string{"Approved", "Rejected"}) {
+		log.Println("expected the workflow described by the document: result received:", w)
+		t.FailNow()
+	}
+
+	m, err := taskmanager.New(taskmanager.WithStore(taskmanager.NewMemoryTaskStore()),
+		taskmanager.WithWorkflows(map[string]taskmanager.TaskWorkflowDefinition{
+			"TaskType": definition,
+		}))
+	if err != nil {
+		log.Println("taskmanager.New:", err)
+		t.FailNow()
+	}
+	_ = m.Open()
+	defer m.Close()
+
+	task := testTask
+	task.Properties = []byte("approve")
+	task, _ = m.CreateTask(task)
+	err = m.StartTask(task.Id)
+	if err != nil {
+		log.Println("taskmanager.StartTask:", err)
+		t.FailNow()
+	}
+	task = runWorkerUntilStatus(t, m, task.Id, "Approved")
+	if atomic.LoadInt32(&checks) != 2 {
+		log.Println("expected loaded workflow to retry and reach 'Approved': result received:", &task)
+		t.FailNow()
+	}
+}
+
+func TestLoadTaskWorkflowJSON(t *testing.T) {
+	definition, err := taskmanager.LoadTaskWorkflow([]byte(`{
+		"sequence": ["Created", "Complete"],
+		"timeouts": {"Created": -1, "Complete": -1},
+		"handlers": {"Created": ["NextStatus"], "Complete": ["EndWorkflow"]}
+	}`), nil)
+	if err != nil {
+		log.Println("taskmanager.LoadTaskWorkflow:", err)
+		t.FailNow()
+	}
+
+	w := definition(context.Background())
+	if !reflect.DeepEqual(w.Sequence, []string{"Created", "Complete"}) || len(w.Handlers["Complete"]) != 1 {
+		log.Println("expected the workflow described by the document: result received:", w)
+		t.FailNow()
+	}
+}
+
+func TestLoadInvalidTaskWorkflow(t *testing.T) {
+	_, err := taskmanager.LoadTaskWorkflow([]byte(`
+sequence: [Created, Complete]
+retries:
+  Created: {maxAttempts: 3, baseDelay: soon}
+handlers:
+  Created: [sendEmail, NextStatus]
+  Complete: [EndWorkflow]
+`), taskmanager.HandlerRegistry{})
+
+	var validationErr *taskmanager.ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 2 {
+		log.Println("expected the unknown handler and invalid delay to be reported: result received:", err)
+		t.FailNow()
+	}
+
+	// Unknown fields are rejected rather than ignored
+	_, err = taskmanager.LoadTaskWorkflow([]byte(`sequnce: [Created]`), nil)
+	if err == nil {
+		log.Println("expected LoadTaskWorkflow to reject an unknown field")
+		t.FailNow()
+	}
+}